@@ -0,0 +1,93 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package chroot starts the daemon subcommand inside a Chrome OS chroot
+// (via sudo and cros_sdk) and connects its stdio to the calling process, so
+// that the caller can speak SSH with it over a socketpair. It is shared by
+// every subcommand that needs to enter the chroot: enter (full interactive
+// session) and tunnel (port forwarding only).
+package chroot
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/daemon"
+)
+
+// Args builds the argv for the sudo invocation that enters the chroot and
+// execs the daemon subcommand through a re-exec of the self binary.
+// sudoArgs are inserted between "sudo" and the rest of the command line,
+// e.g. []string{"--askpass"} or []string{"-n"}. daemonArgs are appended
+// after the daemon subcommand name, e.g. to pass it flags; they pass
+// through the "bash -c" below as plain argv elements, not through a shell,
+// so they need no quoting.
+func Args(rootDir string, loopback bool, sudoArgs, daemonArgs []string) []string {
+	args := append([]string{"sudo"}, sudoArgs...)
+	args = append(args,
+		"env", fmt.Sprintf("DEPOT_TOOLS=%s/src/chromium/depot_tools", rootDir),
+		filepath.Join(rootDir, "chromite/bin/cros_sdk"))
+	if loopback {
+		args = nil
+	}
+	args = append(args, "bash", "-c", `exec 3<&0 0<&1; exec -a "$0" /proc/self/fd/3 "$@"`, os.Args[0], daemon.Command.Name)
+	args = append(args, daemonArgs...)
+	return args
+}
+
+// Start starts cros_sdk (or, in loopback mode, a local shell) with args and
+// env, and returns the calling side of a socketpair connected to its stdio,
+// over which the daemon subcommand speaks SSH.
+func Start(args []string, env []string) (proc *exec.Cmd, procStdio *os.File, retErr error) {
+	// Open the self binary.
+	exePath, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exeFile, err := os.Open(exePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer exeFile.Close()
+
+	// Create a socketpair for communication.
+	// SOCK_CLOEXEC is important to prevent child processes from
+	// inheriting sockets. See comments for syscall.ForkLock for
+	// details.
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	relaySocket := os.NewFile(uintptr(fds[0]), "")
+	daemonSocket := os.NewFile(uintptr(fds[1]), "")
+	defer func() {
+		if retErr != nil {
+			relaySocket.Close()
+		}
+	}()
+	defer daemonSocket.Close()
+
+	proc = exec.Command(args[0], args[1:]...)
+	proc.Env = append(os.Environ(), env...)
+	proc.Stdin = exeFile       // stdin: self exe
+	proc.Stdout = daemonSocket // stdout: socket
+	proc.Stderr = os.Stderr    // stderr: pass through
+	if err := proc.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	// Close the daemon socket now so that we can read EOF from
+	// relaySocket when the subprocess exits.
+	daemonSocket.Close()
+
+	// Wait until stdout becomes readable.
+	unix.Poll([]unix.PollFd{{Fd: int32(relaySocket.Fd()), Events: unix.POLLIN}}, -1)
+
+	return proc, relaySocket, nil
+}
@@ -5,6 +5,7 @@
 package logging
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/syslog"
 	"os"
@@ -24,14 +25,20 @@ var syslogWriter = func() *syslog.Writer {
 type Level int
 
 const (
-	LevelInfo Level = iota
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
 	LevelError
 )
 
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	default:
@@ -39,37 +46,111 @@ func (l Level) String() string {
 	}
 }
 
-func Info(args ...interface{}) {
-	Log(LevelInfo, args...)
+// field is one key/value pair attached to a Logger via With.
+type field struct {
+	key   string
+	value interface{}
 }
 
-func Infof(format string, args ...interface{}) {
-	Logf(LevelInfo, format, args...)
+// Logger emits one JSON object per record to stderr (with a RFC3339Nano
+// timestamp, level, message and any fields attached via With), mirroring
+// each record to syslog at the matching priority. The zero value is a
+// usable logger with no fields attached.
+//
+// With returns a new Logger carrying an additional field, so callers can
+// build up context once (e.g. a connection's remote address) and have it
+// appear on every subsequent log line without repeating it at each call
+// site.
+type Logger struct {
+	fields []field
 }
 
-func Error(args ...interface{}) {
-	Log(LevelError, args...)
+// std is the default Logger used by the package-level functions.
+var std = &Logger{}
+
+// New returns a Logger with no fields attached, equivalent to &Logger{}.
+func New() *Logger {
+	return &Logger{}
 }
 
-func Errorf(format string, args ...interface{}) {
-	Logf(LevelError, format, args...)
+func With(key string, value interface{}) *Logger {
+	return std.With(key, value)
 }
 
-func Log(level Level, args ...interface{}) {
-	log(level, fmt.Sprint(args...))
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	fields = append(fields, field{key, value})
+	return &Logger{fields: fields}
 }
 
+func Debug(args ...interface{})                 { std.Debug(args...) }
+func Debugf(format string, args ...interface{}) { std.Debugf(format, args...) }
+func Info(args ...interface{})                  { std.Info(args...) }
+func Infof(format string, args ...interface{})  { std.Infof(format, args...) }
+func Warn(args ...interface{})                  { std.Warn(args...) }
+func Warnf(format string, args ...interface{})  { std.Warnf(format, args...) }
+func Error(args ...interface{})                 { std.Error(args...) }
+func Errorf(format string, args ...interface{}) { std.Errorf(format, args...) }
+func Log(level Level, args ...interface{})      { std.Log(level, args...) }
 func Logf(level Level, format string, args ...interface{}) {
-	log(level, fmt.Sprintf(format, args...))
+	std.Logf(level, format, args...)
+}
+
+func (l *Logger) Debug(args ...interface{}) { l.Log(LevelDebug, args...) }
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.Logf(LevelDebug, format, args...)
+}
+func (l *Logger) Info(args ...interface{}) { l.Log(LevelInfo, args...) }
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Logf(LevelInfo, format, args...)
+}
+func (l *Logger) Warn(args ...interface{}) { l.Log(LevelWarn, args...) }
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Logf(LevelWarn, format, args...)
+}
+func (l *Logger) Error(args ...interface{}) { l.Log(LevelError, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Logf(LevelError, format, args...)
+}
+
+func (l *Logger) Log(level Level, args ...interface{}) {
+	l.log(level, fmt.Sprint(args...))
 }
 
-func log(level Level, msg string) {
-	line := fmt.Sprintf("%s %s %s\n", time.Now().Format(time.RFC3339Nano), level, msg)
-	os.Stderr.WriteString(line)
+func (l *Logger) Logf(level Level, format string, args ...interface{}) {
+	l.log(level, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) log(level Level, msg string) {
+	record := make(map[string]interface{}, len(l.fields)+3)
+	for _, f := range l.fields {
+		record[f.key] = f.value
+	}
+	record["time"] = time.Now().Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	record["msg"] = msg
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		// Fields of an unexpected type shouldn't take down logging
+		// entirely; fall back to a record that's guaranteed to marshal.
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":  time.Now().Format(time.RFC3339Nano),
+			"level": LevelError.String(),
+			"msg":   fmt.Sprintf("failed to marshal log record: %v", err),
+		})
+	}
+	os.Stderr.Write(append(line, '\n'))
+
 	if syslogWriter != nil {
 		switch level {
+		case LevelDebug:
+			syslogWriter.Debug(msg)
 		case LevelInfo:
 			syslogWriter.Info(msg)
+		case LevelWarn:
+			syslogWriter.Warning(msg)
 		case LevelError:
 			syslogWriter.Err(msg)
 		}
@@ -5,7 +5,9 @@
 package daemon
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 
 	"github.com/urfave/cli/v2"
@@ -17,25 +19,115 @@ import (
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshd"
 )
 
+// metricsAddrFlag is the listen address for the optional Prometheus metrics
+// endpoint. It's empty (disabled) by default, since most invocations of the
+// daemon are short-lived dev sessions that have no operator scraping them.
+var metricsAddrFlag = &cli.StringFlag{
+	Name:  "metrics-addr",
+	Usage: "if set, serve Prometheus metrics on this address (e.g. localhost:9100)",
+}
+
+// keepaliveIntervalFlag and keepaliveMaxMissedFlag configure Run's
+// server-initiated keepalive. Zero (the default) disables it, matching the
+// daemon's previous behavior of only replying to the peer's own probes.
+var keepaliveIntervalFlag = &cli.DurationFlag{
+	Name:  "keepalive-interval",
+	Usage: "if set, probe the peer with a keepalive@openssh.com request this often, closing the connection if it stops responding",
+}
+
+var keepaliveMaxMissedFlag = &cli.IntFlag{
+	Name:  "keepalive-max-missed",
+	Usage: "number of consecutive unanswered keepalive probes tolerated before closing the connection (ignored unless --keepalive-interval is set; 0 is treated as 1)",
+}
+
+// idleTimeoutFlag closes an idle session or forwarded connection. Zero
+// (the default) disables it.
+var idleTimeoutFlag = &cli.DurationFlag{
+	Name:  "idle-timeout",
+	Usage: "if set, close a session or forwarded connection once it's carried no traffic for this long",
+}
+
+// permissionsFlag carries the *ssh.Permissions the enter subcommand's relay
+// determined for this connection, from whatever authorized_keys entry
+// authenticated the user. The daemon's own ServerConn performs no
+// authentication of its own (see NoClientAuth below), so this is its only
+// way to learn what the connection is actually authorized to do; EncodeArgs
+// produces the flag, and the Action below decodes it into a
+// NoClientAuthCallback. Unset (the default), the connection is
+// unrestricted, same as before this flag existed.
+var permissionsFlag = &cli.StringFlag{
+	Name:   "permissions",
+	Hidden: true,
+	Usage:  "JSON-encoded ssh.Permissions to enforce for this connection (set internally by the enter subcommand)",
+}
+
+// EncodePermissionsArgs returns the daemon subcommand flags that make Run
+// enforce permissions for the resulting connection, or nil if permissions
+// is nil.
+func EncodePermissionsArgs(permissions *ssh.Permissions) ([]string, error) {
+	if permissions == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(permissions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode daemon permissions: %w", err)
+	}
+	return []string{"--" + permissionsFlag.Name, string(data)}, nil
+}
+
 var Command = &cli.Command{
 	Name:   "daemon",
 	Hidden: true,
-	Flags:  []cli.Flag{},
+	Flags:  []cli.Flag{metricsAddrFlag, keepaliveIntervalFlag, keepaliveMaxMissedFlag, idleTimeoutFlag, permissionsFlag},
 	Usage:  "starts daemon in chroot",
 	Action: func(c *cli.Context) error {
 		logging.Info("Starting daemon (inside chroot)")
 
+		hostKey, err := sshd.PersistentSigner(sshd.DefaultHostKeyPath())
+		if err != nil {
+			return fmt.Errorf("failed to load daemon host key: %w", err)
+		}
+
 		cfg := &ssh.ServerConfig{
 			NoClientAuth: true,
 		}
-		cfg.AddHostKey(sshd.MockSigner)
+		if raw := c.String(permissionsFlag.Name); raw != "" {
+			var permissions ssh.Permissions
+			if err := json.Unmarshal([]byte(raw), &permissions); err != nil {
+				return fmt.Errorf("failed to decode --%s: %w", permissionsFlag.Name, err)
+			}
+			cfg.NoClientAuthCallback = func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+				return &permissions, nil
+			}
+		}
+		cfg.AddHostKey(hostKey)
 		serverConn, newChans, globalReqs, err := ssh.NewServerConn(pipe.NewConn(os.Stdin, os.Stdout), cfg)
 		if err != nil {
 			return fmt.Errorf("external handshake failed: %w", err)
 		}
 		defer serverConn.Close()
 
-		daemonsshd.Run(serverConn, newChans, globalReqs)
+		stop := make(chan struct{})
+		defer close(stop)
+		go sshd.RunKeepalive(serverConn, stop)
+
+		metrics := daemonsshd.NewMetrics()
+		if addr := c.String(metricsAddrFlag.Name); addr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			go func() {
+				if err := http.ListenAndServe(addr, mux); err != nil {
+					logging.Errorf("Metrics listener on %s failed: %v", addr, err)
+				}
+			}()
+		}
+
+		sshdCfg := daemonsshd.Config{
+			KeepaliveInterval:  c.Duration(keepaliveIntervalFlag.Name),
+			KeepaliveMaxMissed: c.Int(keepaliveMaxMissedFlag.Name),
+			IdleTimeout:        c.Duration(idleTimeoutFlag.Name),
+		}
+		daemonsshd.Run(serverConn, newChans, globalReqs, daemonsshd.PermissionsAuthorizer{}, logging.New(), sshdCfg, metrics)
 		return nil
 	},
 }
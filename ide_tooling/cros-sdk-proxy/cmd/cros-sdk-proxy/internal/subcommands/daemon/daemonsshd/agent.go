@@ -0,0 +1,101 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/logging"
+)
+
+// agentChannelType is the SSH channel type used by OpenSSH agent forwarding,
+// as specified by draft-ietf-secsh-connect and implemented by most clients.
+const agentChannelType = "auth-agent@openssh.com"
+
+// agentForward listens on a UNIX domain socket and, for every connection
+// accepted on it, opens an agentChannelType channel back to serverConn and
+// bridges the two. The caller is expected to export the returned socket path
+// to the session as SSH_AUTH_SOCK.
+type agentForward struct {
+	dir      string
+	listener *net.UnixListener
+}
+
+// startAgentForward creates a session-scoped UNIX socket that proxies
+// connections to the ssh-agent held by the relay (and, transitively, the
+// user's local ssh-agent), so that commands started inside the chroot (git,
+// repo, gcloud) can use passphrase-protected keys without the private key
+// ever entering the chroot.
+func startAgentForward(serverConn *ssh.ServerConn) (*agentForward, error) {
+	dir, err := os.MkdirTemp("", "cros-sdk-proxy-agent.*")
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &net.UnixAddr{Net: "unix", Name: dir + "/agent.sock"}
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	af := &agentForward{dir: dir, listener: listener}
+
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				return
+			}
+			go af.serveConn(serverConn, conn)
+		}
+	}()
+
+	return af, nil
+}
+
+func (af *agentForward) serveConn(serverConn *ssh.ServerConn, conn *net.UnixConn) {
+	ch, reqs, err := serverConn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		logging.Errorf("Failed to open %s channel: %v", agentChannelType, err)
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	defer ch.Close()
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, ch)
+		conn.CloseWrite()
+	}()
+	wg.Wait()
+}
+
+// SocketPath returns the path of the UNIX socket that should be exported as
+// SSH_AUTH_SOCK for the session.
+func (af *agentForward) SocketPath() string {
+	return af.listener.Addr().(*net.UnixAddr).Name
+}
+
+// Close stops accepting new agent connections and removes the socket.
+func (af *agentForward) Close() {
+	af.listener.Close()
+	os.RemoveAll(af.dir)
+}
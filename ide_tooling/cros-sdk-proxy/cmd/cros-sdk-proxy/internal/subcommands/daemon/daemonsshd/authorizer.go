@@ -0,0 +1,149 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Authorizer decides whether a session may open a given channel or global
+// request, and what command it's actually allowed to run. Run consults it
+// before accepting a "session" channel, dialing the target of a
+// "direct-tcpip" channel, honoring a "tcpip-forward"/"cancel-tcpip-forward"
+// global request, and honoring an "exec"/"shell"/"pty-req" channel
+// request, so operators can lock the proxy down for multi-tenant use.
+//
+// Implementations typically derive their decisions from serverConn's
+// Permissions, which is populated by whatever ssh.ServerConfig auth
+// callback (or NoClientAuthCallback) authenticated the connection.
+type Authorizer interface {
+	// AuthorizeSession is consulted before accepting a "session" channel.
+	AuthorizeSession(serverConn *ssh.ServerConn) error
+
+	// AuthorizeDirectTCPIP is consulted before dialing the target of a
+	// "direct-tcpip" channel.
+	AuthorizeDirectTCPIP(serverConn *ssh.ServerConn, host string, port uint32) error
+
+	// AuthorizeTCPIPForward is consulted before honoring a
+	// "tcpip-forward" or "cancel-tcpip-forward" global request.
+	AuthorizeTCPIPForward(serverConn *ssh.ServerConn, bindAddress string, bindPort uint32) error
+
+	// AuthorizeCommand is consulted before honoring an "exec", "shell" or
+	// "pty-req" channel request, with the user-supplied command (empty
+	// for "shell" and "pty-req"). It returns the command that should
+	// actually run: command unchanged, unless the session is restricted
+	// to a force-command, in which case that command is returned
+	// instead and the caller is expected to expose the original command
+	// to the process as SSH_ORIGINAL_COMMAND.
+	AuthorizeCommand(serverConn *ssh.ServerConn, command string) (string, error)
+}
+
+// AllowAll is an Authorizer that permits everything and never overrides the
+// requested command. It's the default for connections that don't enforce
+// any per-session restrictions.
+type AllowAll struct{}
+
+func (AllowAll) AuthorizeSession(*ssh.ServerConn) error { return nil }
+
+func (AllowAll) AuthorizeDirectTCPIP(*ssh.ServerConn, string, uint32) error { return nil }
+
+func (AllowAll) AuthorizeTCPIPForward(*ssh.ServerConn, string, uint32) error { return nil }
+
+func (AllowAll) AuthorizeCommand(_ *ssh.ServerConn, command string) (string, error) {
+	return command, nil
+}
+
+// PermissionsAuthorizer is an Authorizer that enforces restrictions
+// attached to the connection's ssh.Permissions, using the same
+// CriticalOptions/Extensions names as OpenSSH's authorized_keys options:
+// the "force-command" and "source-address" critical options, and the
+// "permitopen"/"permitlisten" extensions (comma-separated host:port
+// entries; "*" as the port matches any port). A connection with no
+// Permissions at all, or without a given option set, is unrestricted for
+// that option.
+type PermissionsAuthorizer struct{}
+
+func (PermissionsAuthorizer) AuthorizeSession(serverConn *ssh.ServerConn) error {
+	perms := serverConn.Permissions
+	if perms == nil {
+		return nil
+	}
+	if pattern, ok := perms.CriticalOptions["source-address"]; ok {
+		return checkSourceAddress(serverConn.RemoteAddr(), pattern)
+	}
+	return nil
+}
+
+func (PermissionsAuthorizer) AuthorizeDirectTCPIP(serverConn *ssh.ServerConn, host string, port uint32) error {
+	return checkPermitList(serverConn.Permissions, "permitopen", host, port)
+}
+
+func (PermissionsAuthorizer) AuthorizeTCPIPForward(serverConn *ssh.ServerConn, bindAddress string, bindPort uint32) error {
+	return checkPermitList(serverConn.Permissions, "permitlisten", bindAddress, bindPort)
+}
+
+func (PermissionsAuthorizer) AuthorizeCommand(serverConn *ssh.ServerConn, command string) (string, error) {
+	if serverConn.Permissions == nil {
+		return command, nil
+	}
+	if forced, ok := serverConn.Permissions.CriticalOptions["force-command"]; ok {
+		return forced, nil
+	}
+	return command, nil
+}
+
+// checkPermitList enforces the allowed host:port entries named by
+// extension (e.g. "permitopen", "permitlisten") in perms.Extensions
+// against host:port. A missing extension means unrestricted.
+func checkPermitList(perms *ssh.Permissions, extension, host string, port uint32) error {
+	if perms == nil {
+		return nil
+	}
+	list, ok := perms.Extensions[extension]
+	if !ok {
+		return nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			continue
+		}
+		if entryHost == host && (entryPort == "*" || entryPort == strconv.FormatUint(uint64(port), 10)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not permitted by %s", net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)), extension)
+}
+
+// checkSourceAddress enforces that addr's host matches one of the
+// comma-separated host or CIDR patterns in pattern, mirroring OpenSSH's
+// "source-address" critical option.
+func checkSourceAddress(addr net.Addr, pattern string) error {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+
+	for _, p := range strings.Split(pattern, ",") {
+		p = strings.TrimSpace(p)
+		if p == host {
+			return nil
+		}
+		if ip == nil {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(p); err == nil && cidr.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source address %s not permitted", host)
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCheckPermitList(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		perms   *ssh.Permissions
+		host    string
+		port    uint32
+		wantErr bool
+	}{
+		{name: "nil permissions is unrestricted", perms: nil, host: "example.com", port: 22},
+		{name: "no extension is unrestricted", perms: &ssh.Permissions{}, host: "example.com", port: 22},
+		{name: "exact match", perms: &ssh.Permissions{Extensions: map[string]string{"permitopen": "example.com:22"}}, host: "example.com", port: 22},
+		{name: "wildcard port", perms: &ssh.Permissions{Extensions: map[string]string{"permitopen": "example.com:*"}}, host: "example.com", port: 443},
+		{name: "one of several entries", perms: &ssh.Permissions{Extensions: map[string]string{"permitopen": "a.example:80,example.com:22"}}, host: "example.com", port: 22},
+		{name: "host mismatch", perms: &ssh.Permissions{Extensions: map[string]string{"permitopen": "other.example:22"}}, host: "example.com", port: 22, wantErr: true},
+		{name: "port mismatch", perms: &ssh.Permissions{Extensions: map[string]string{"permitopen": "example.com:22"}}, host: "example.com", port: 23, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkPermitList(tc.perms, "permitopen", tc.host, tc.port)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkPermitList(%v, %q, %d) error = %v, wantErr %v", tc.perms, tc.host, tc.port, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSourceAddress(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pattern string
+		addr    string
+		wantErr bool
+	}{
+		{name: "exact host match", pattern: "10.0.0.1", addr: "10.0.0.1:1234"},
+		{name: "cidr match", pattern: "10.0.0.0/24", addr: "10.0.0.5:1234"},
+		{name: "one of several patterns", pattern: "192.168.1.1,10.0.0.0/24", addr: "10.0.0.5:1234"},
+		{name: "no match", pattern: "192.168.1.0/24", addr: "10.0.0.5:1234", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := net.ResolveTCPAddr("tcp", tc.addr)
+			if err != nil {
+				t.Fatalf("ResolveTCPAddr(%q): %v", tc.addr, err)
+			}
+			err = checkSourceAddress(addr, tc.pattern)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkSourceAddress(%s, %q) error = %v, wantErr %v", addr, tc.pattern, err, tc.wantErr)
+			}
+		})
+	}
+}
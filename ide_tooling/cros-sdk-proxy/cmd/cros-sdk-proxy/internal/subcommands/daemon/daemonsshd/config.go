@@ -0,0 +1,28 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import "time"
+
+// Config holds tunables for Run's server-initiated keepalive and
+// idle-timeout behavior. The zero Config disables both, matching Run's
+// previous behavior of only replying to the peer's own keepalive probes
+// and never closing an idle session or forward on its own.
+type Config struct {
+	// KeepaliveInterval is how often Run probes the peer with a
+	// keepalive@openssh.com global request. Zero disables server-initiated
+	// keepalives.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveMaxMissed is how many consecutive unanswered keepalive
+	// probes Run tolerates before tearing the connection down. Ignored if
+	// KeepaliveInterval is zero; zero is treated as 1.
+	KeepaliveMaxMissed int
+
+	// IdleTimeout closes a session channel (after sending SIGHUP to its
+	// child process) or a forwarded connection once it sees no stdio or
+	// forwarded traffic for this long. Zero disables idle timeouts.
+	IdleTimeout time.Duration
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/logging"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshchan"
+)
+
+// tcpipForwardRequest builds a "tcpip-forward"-shaped *ssh.Request.
+// WantReply is always false, since ssh.Request.Reply with WantReply true
+// dereferences fields only a real handshake populates; tests instead
+// observe handleGlobalRequest's effect on the forwards map directly.
+func tcpipForwardRequest(t *testing.T, reqType, bindAddress string, bindPort uint32) *ssh.Request {
+	t.Helper()
+	var payload []byte
+	switch reqType {
+	case "tcpip-forward":
+		payload = ssh.Marshal(&sshchan.TCPIPForwardPayload{BindAddress: bindAddress, BindPort: bindPort})
+	case "cancel-tcpip-forward":
+		payload = ssh.Marshal(&sshchan.CancelTCPIPForwardPayload{BindAddress: bindAddress, BindPort: bindPort})
+	default:
+		t.Fatalf("unsupported request type %q", reqType)
+	}
+	return &ssh.Request{Type: reqType, Payload: payload}
+}
+
+func TestHandleGlobalRequestTCPIPForwardRejectsDuplicateBind(t *testing.T) {
+	serverConn := &ssh.ServerConn{}
+	forwards := map[forwardKey]*net.TCPListener{}
+	streamForwards := map[string]*net.UnixListener{}
+	logger := logging.New()
+	metrics := NewMetrics()
+	var wg sync.WaitGroup
+
+	handleGlobalRequest(serverConn, tcpipForwardRequest(t, "tcpip-forward", "localhost", 0), forwards, streamForwards, AllowAll{}, logger, Config{}, metrics, &wg)
+	if len(forwards) != 1 {
+		t.Fatalf("len(forwards) = %d after first tcpip-forward, want 1", len(forwards))
+	}
+	var key forwardKey
+	for k := range forwards {
+		key = k
+	}
+
+	// A second request for the same bind address/port must be rejected
+	// instead of clobbering the map entry and leaking the original
+	// listener and its serveForwards goroutine.
+	handleGlobalRequest(serverConn, tcpipForwardRequest(t, "tcpip-forward", key.BindAddress, key.BindPort), forwards, streamForwards, AllowAll{}, logger, Config{}, metrics, &wg)
+	if len(forwards) != 1 {
+		t.Fatalf("len(forwards) = %d after duplicate tcpip-forward, want 1", len(forwards))
+	}
+
+	handleGlobalRequest(serverConn, tcpipForwardRequest(t, "cancel-tcpip-forward", key.BindAddress, key.BindPort), forwards, streamForwards, AllowAll{}, logger, Config{}, metrics, &wg)
+	if len(forwards) != 0 {
+		t.Fatalf("len(forwards) = %d after cancel-tcpip-forward, want 0", len(forwards))
+	}
+	wg.Wait()
+}
+
+func TestHandleGlobalRequestCancelTCPIPForwardUnknownIsNoop(t *testing.T) {
+	serverConn := &ssh.ServerConn{}
+	forwards := map[forwardKey]*net.TCPListener{}
+	streamForwards := map[string]*net.UnixListener{}
+	logger := logging.New()
+	metrics := NewMetrics()
+	var wg sync.WaitGroup
+
+	handleGlobalRequest(serverConn, tcpipForwardRequest(t, "cancel-tcpip-forward", "localhost", 12345), forwards, streamForwards, AllowAll{}, logger, Config{}, metrics, &wg)
+	if len(forwards) != 0 {
+		t.Errorf("len(forwards) = %d after cancelling an unregistered forward, want 0", len(forwards))
+	}
+}
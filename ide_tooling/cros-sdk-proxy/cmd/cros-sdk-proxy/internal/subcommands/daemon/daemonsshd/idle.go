@@ -0,0 +1,94 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshchan"
+)
+
+// idleMonitor tracks the last time touch was called and lets watch block
+// until either stop is called or timeout elapses since the last touch.
+type idleMonitor struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	last    time.Time
+	stopped chan struct{}
+}
+
+func newIdleMonitor(timeout time.Duration) *idleMonitor {
+	return &idleMonitor{timeout: timeout, last: time.Now(), stopped: make(chan struct{})}
+}
+
+func (m *idleMonitor) touch() {
+	m.mu.Lock()
+	m.last = time.Now()
+	m.mu.Unlock()
+}
+
+// stop releases a goroutine blocked in watch without invoking onTimeout.
+func (m *idleMonitor) stop() {
+	close(m.stopped)
+}
+
+// watch blocks until stop is called, or until timeout elapses since the
+// last touch, in which case it invokes onTimeout before returning.
+func (m *idleMonitor) watch(onTimeout func()) {
+	for {
+		m.mu.Lock()
+		remaining := m.timeout - time.Since(m.last)
+		m.mu.Unlock()
+		if remaining <= 0 {
+			onTimeout()
+			return
+		}
+		select {
+		case <-m.stopped:
+			return
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// touchReader wraps r, calling touch after every successful read.
+type touchReader struct {
+	io.Reader
+	touch func()
+}
+
+func (t touchReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if n > 0 {
+		t.touch()
+	}
+	return n, err
+}
+
+// touchWriter wraps w, calling touch after every successful write. If w
+// implements sshchan.CloseWriter, so does touchWriter, forwarding to w, so
+// that wrapping a writer for idle tracking doesn't hide its ability to be
+// half-closed (see sshchan.CopyHalf).
+type touchWriter struct {
+	io.Writer
+	touch func()
+}
+
+func (t touchWriter) Write(p []byte) (int, error) {
+	n, err := t.Writer.Write(p)
+	if n > 0 {
+		t.touch()
+	}
+	return n, err
+}
+
+func (t touchWriter) CloseWrite() error {
+	if cw, ok := t.Writer.(sshchan.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleMonitorWatchFiresOnTimeout(t *testing.T) {
+	m := newIdleMonitor(10 * time.Millisecond)
+
+	fired := make(chan struct{})
+	go m.watch(func() { close(fired) })
+
+	select {
+	case <-fired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("onTimeout was not called after the idle timeout elapsed")
+	}
+}
+
+func TestIdleMonitorStopPreventsTimeout(t *testing.T) {
+	m := newIdleMonitor(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	fired := false
+	go func() {
+		m.watch(func() { fired = true })
+		close(done)
+	}()
+
+	m.stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watch did not return after stop was called")
+	}
+	if fired {
+		t.Error("onTimeout was called despite stop being called first")
+	}
+}
+
+func TestIdleMonitorTouchResetsDeadline(t *testing.T) {
+	m := newIdleMonitor(30 * time.Millisecond)
+
+	fired := make(chan struct{})
+	go m.watch(func() { close(fired) })
+
+	// Keep touching well within the timeout so it never elapses, then
+	// confirm onTimeout hasn't fired yet.
+	for i := 0; i < 3; i++ {
+		time.Sleep(15 * time.Millisecond)
+		m.touch()
+	}
+	select {
+	case <-fired:
+		t.Fatal("onTimeout was called despite touch repeatedly resetting the deadline")
+	default:
+	}
+	m.stop()
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/logging"
+)
+
+// fakeConn implements ssh.Conn, with every method but SendRequest left to
+// panic on use (none of them are exercised by runServerKeepalive).
+type fakeConn struct {
+	ssh.Conn
+
+	fail func(call int) bool
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *fakeConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	f.mu.Lock()
+	f.calls++
+	call := f.calls
+	f.mu.Unlock()
+	if f.fail(call) {
+		return false, nil, errors.New("no reply")
+	}
+	return true, nil, nil
+}
+
+func TestRunServerKeepaliveCancelsAfterMaxMissed(t *testing.T) {
+	conn := &fakeConn{fail: func(int) bool { return true }}
+	serverConn := &ssh.ServerConn{Conn: conn}
+	cfg := Config{KeepaliveInterval: 2 * time.Millisecond, KeepaliveMaxMissed: 3}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		runServerKeepalive(ctx, serverConn, cfg, cancel, logging.New())
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancel was not called after KeepaliveMaxMissed consecutive failed probes")
+	}
+	<-done
+}
+
+func TestRunServerKeepaliveResetsMissedCountOnSuccess(t *testing.T) {
+	// Every other probe fails, so with a max of 2 consecutive misses,
+	// the connection should never be cancelled.
+	conn := &fakeConn{fail: func(call int) bool { return call%2 == 0 }}
+	serverConn := &ssh.ServerConn{Conn: conn}
+	cfg := Config{KeepaliveInterval: 2 * time.Millisecond, KeepaliveMaxMissed: 2}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go runServerKeepalive(ctx, serverConn, cfg, cancel, logging.New())
+
+	// Let several probe intervals elapse, then confirm cancel was never
+	// called.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-ctx.Done():
+		t.Fatal("connection was cancelled despite never missing two consecutive probes")
+	default:
+	}
+	cancel()
+}
+
+func TestRunServerKeepaliveZeroMaxMissedTreatedAsOne(t *testing.T) {
+	conn := &fakeConn{fail: func(int) bool { return true }}
+	serverConn := &ssh.ServerConn{Conn: conn}
+	cfg := Config{KeepaliveInterval: 2 * time.Millisecond, KeepaliveMaxMissed: 0}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runServerKeepalive(ctx, serverConn, cfg, cancel, logging.New())
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancel was not called after a single missed probe with KeepaliveMaxMissed unset")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshchan"
+)
+
+// Metrics holds the Prometheus collectors that Run and its helpers update.
+// It has its own registry, so multiple daemons in the same process (there
+// is normally only one) don't collide on metric names. Use NewMetrics to
+// construct one; a nil *Metrics passed to Run is replaced with a fresh one,
+// same as a nil Authorizer or Logger.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	activeConnections   prometheus.Gauge
+	sessionsOpenedTotal prometheus.Counter
+	sessionsClosedTotal *prometheus.CounterVec // by exit_code
+	channelsOpenedTotal *prometheus.CounterVec // by channel_type
+	channelsClosedTotal *prometheus.CounterVec // by channel_type
+	activeForwards      prometheus.Gauge
+	bytesTotal          *prometheus.CounterVec // by channel_type, direction
+	ptyResizeTotal      prometheus.Counter
+}
+
+// NewMetrics creates a Metrics with its own registry, ready to be served
+// by Handler.
+func NewMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+	factory := promauto.With(registry)
+	return &Metrics{
+		registry: registry,
+		activeConnections: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "cros_sdk_proxy_active_connections",
+			Help: "Number of SSH connections currently being served.",
+		}),
+		sessionsOpenedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "cros_sdk_proxy_sessions_opened_total",
+			Help: "Number of sessions (shell/exec) that started a process.",
+		}),
+		sessionsClosedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cros_sdk_proxy_sessions_closed_total",
+			Help: "Number of sessions that finished, labeled by exit code.",
+		}, []string{"exit_code"}),
+		channelsOpenedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cros_sdk_proxy_channels_opened_total",
+			Help: "Number of channels opened, labeled by channel type.",
+		}, []string{"channel_type"}),
+		channelsClosedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cros_sdk_proxy_channels_closed_total",
+			Help: "Number of channels closed, labeled by channel type.",
+		}, []string{"channel_type"}),
+		activeForwards: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "cros_sdk_proxy_active_forwards",
+			Help: "Number of active tcpip-forward listeners.",
+		}),
+		bytesTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "cros_sdk_proxy_bytes_total",
+			Help: "Bytes copied, labeled by channel type and direction (rx: from the SSH peer, tx: to the SSH peer).",
+		}, []string{"channel_type", "direction"}),
+		ptyResizeTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: "cros_sdk_proxy_pty_resize_total",
+			Help: "Number of pty resize (window-change) requests handled.",
+		}),
+	}
+}
+
+// Handler returns an http.Handler serving m's metrics in the Prometheus
+// text exposition format, suitable for mounting at /metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) connectionOpened() { m.activeConnections.Inc() }
+func (m *Metrics) connectionClosed() { m.activeConnections.Dec() }
+
+func (m *Metrics) sessionOpened() { m.sessionsOpenedTotal.Inc() }
+func (m *Metrics) sessionClosed(exitCode int) {
+	m.sessionsClosedTotal.WithLabelValues(strconv.Itoa(exitCode)).Inc()
+}
+
+func (m *Metrics) channelOpened(channelType string) {
+	m.channelsOpenedTotal.WithLabelValues(channelType).Inc()
+}
+func (m *Metrics) channelClosed(channelType string) {
+	m.channelsClosedTotal.WithLabelValues(channelType).Inc()
+}
+
+func (m *Metrics) forwardOpened() { m.activeForwards.Inc() }
+func (m *Metrics) forwardClosed() { m.activeForwards.Dec() }
+
+func (m *Metrics) addBytes(channelType, direction string, n int) {
+	if n <= 0 {
+		return
+	}
+	m.bytesTotal.WithLabelValues(channelType, direction).Add(float64(n))
+}
+
+func (m *Metrics) ptyResize() { m.ptyResizeTotal.Inc() }
+
+// countingReader wraps r, reporting every successful read's byte count to
+// report.
+type countingReader struct {
+	io.Reader
+	report func(n int)
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if n > 0 {
+		c.report(n)
+	}
+	return n, err
+}
+
+// countingWriter wraps w, reporting every successful write's byte count to
+// report. If w implements sshchan.CloseWriter, so does countingWriter,
+// forwarding to w (see touchWriter's CloseWrite for why this matters).
+type countingWriter struct {
+	io.Writer
+	report func(n int)
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	if n > 0 {
+		c.report(n)
+	}
+	return n, err
+}
+
+func (c countingWriter) CloseWrite() error {
+	if cw, ok := c.Writer.(sshchan.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
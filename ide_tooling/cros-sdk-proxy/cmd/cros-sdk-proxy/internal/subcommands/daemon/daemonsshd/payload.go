@@ -22,6 +22,10 @@ type execPayload struct {
 	Command string
 }
 
+type subsystemPayload struct {
+	Name string
+}
+
 type windowChangePayload struct {
 	WidthInChars   uint32
 	HeightInChars  uint32
@@ -40,30 +44,28 @@ type exitSignalPayload struct {
 	LanguageTag  string
 }
 
-type directTCPIPPayload struct {
-	TargetHost     string
-	TargetPort     uint32
-	OriginatorHost string
-	OriginatorPort uint32
-}
+// The "direct-tcpip"/"tcpip-forward" family of payloads live in sshchan,
+// shared with the tunnel subcommand, which forwards the same channel types
+// over its own SSH connection to the daemon.
+
+// These mirror the wire payloads for OpenSSH's UNIX domain socket
+// forwarding extension; see PROTOCOL in the openssh-portable source tree.
 
-type tcpipForwardPayload struct {
-	BindAddress string
-	BindPort    uint32
+type directStreamLocalPayload struct {
+	SocketPath string
+	Reserved1  string
+	Reserved2  uint32
 }
 
-type tcpipForwardSuccessPayload struct {
-	BindPort uint32
+type streamLocalForwardPayload struct {
+	SocketPath string
 }
 
-type cancelTCPIPForwardPayload struct {
-	BindAddress string
-	BindPort    uint32
+type cancelStreamLocalForwardPayload struct {
+	SocketPath string
 }
 
-type forwardedTCPIPPayload struct {
-	ConnectedHost  string
-	ConnectedPort  uint32
-	OriginatorHost string
-	OriginatorPort uint32
+type forwardedStreamLocalPayload struct {
+	SocketPath string
+	Reserved   string
 }
@@ -0,0 +1,41 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"io"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/logging"
+)
+
+// startSFTPSubsystem runs an in-process SFTP server over ch, so that tools
+// relying on the "sftp" subsystem (VSCode Remote-SSH file operations, the
+// sftp and rsync -e ssh commands) can access files inside the chroot. Since
+// the daemon itself runs inside the chroot, the server is naturally rooted
+// at the chroot filesystem without any extra chrooting.
+func startSFTPSubsystem(ch ssh.Channel) (<-chan struct{}, error) {
+	server, err := sftp.NewServer(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	procCh := make(chan struct{})
+	go func() {
+		defer close(procCh)
+		defer server.Close()
+
+		err := server.Serve()
+		code := uint32(0)
+		if err != nil && err != io.EOF {
+			logging.Errorf("sftp subsystem exited with error: %v", err)
+			code = 1
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(&exitStatusPayload{Code: code}))
+	}()
+	return procCh, nil
+}
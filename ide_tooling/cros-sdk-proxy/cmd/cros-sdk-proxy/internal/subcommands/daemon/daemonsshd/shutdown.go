@@ -0,0 +1,44 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package daemonsshd
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// processRegistry tracks the child processes started by runCommand, so that
+// Run's shutdown path can signal all of them instead of leaving them
+// running when the SSH connection goes away.
+type processRegistry struct {
+	mu    sync.Mutex
+	procs map[*os.Process]struct{}
+}
+
+func (r *processRegistry) add(p *os.Process) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.procs == nil {
+		r.procs = make(map[*os.Process]struct{})
+	}
+	r.procs[p] = struct{}{}
+}
+
+func (r *processRegistry) remove(p *os.Process) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.procs, p)
+}
+
+// signal sends sig to every currently-registered process.
+func (r *processRegistry) signal(sig unix.Signal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for p := range r.procs {
+		p.Signal(sig)
+	}
+}
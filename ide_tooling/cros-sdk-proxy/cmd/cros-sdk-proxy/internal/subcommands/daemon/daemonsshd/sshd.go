@@ -5,22 +5,26 @@
 package daemonsshd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sys/unix"
 
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/logging"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshchan"
 )
 
 type forwardKey struct {
@@ -28,42 +32,230 @@ type forwardKey struct {
 	BindPort    uint32
 }
 
-func Run(serverConn *ssh.ServerConn, newChans <-chan ssh.NewChannel, globalReqs <-chan *ssh.Request) {
+// isLoopbackHost reports whether host is one that net.Listen("tcp",
+// "localhost:...") would also bind: empty, "localhost", or a loopback IP
+// literal.
+func isLoopbackHost(host string) bool {
+	if host == "" || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// shutdownSignals trigger an orderly shutdown of Run instead of the
+// default action of killing the process outright, which used to race the
+// daemon's own cleanup of remote forwards and strand listener sockets and
+// half-open forwarded connections.
+var shutdownSignals = []os.Signal{unix.SIGHUP, unix.SIGTERM, unix.SIGINT}
+
+// shutdownDrainTimeout bounds how long Run waits for in-flight sessions and
+// forwards to exit once a shutdown has been initiated, so a child process
+// or copy loop that ignores SIGHUP can't hang the daemon forever.
+const shutdownDrainTimeout = 5 * time.Second
+
+// Run serves newChans and globalReqs on serverConn until the connection is
+// closed or one of shutdownSignals is received, consulting authz before
+// honoring anything it covers. A nil authz is equivalent to AllowAll{}.
+//
+// logger is used for every log line Run and its helpers emit, tagged with
+// the connection's remote address so log lines from concurrent sessions
+// can be told apart; a nil logger is equivalent to logging.New().
+//
+// cfg's KeepaliveInterval/KeepaliveMaxMissed enable a server-initiated
+// keepalive that tears the connection down after too many unanswered
+// probes, and cfg.IdleTimeout closes an idle session or forwarded
+// connection; the zero Config disables both, as before this existed.
+//
+// metrics is updated with connection, session, channel and byte counters as
+// Run and its helpers process the connection; a nil metrics is equivalent
+// to NewMetrics(). Run itself never exposes metrics over HTTP, that's up
+// to the caller via metrics.Handler.
+//
+// On shutdown, Run stops accepting new channels, sends SIGHUP to every
+// child process started by a session, closes all forward listeners, closes
+// serverConn, and waits up to shutdownDrainTimeout for in-flight sessions
+// and forwards to exit before returning.
+func Run(serverConn *ssh.ServerConn, newChans <-chan ssh.NewChannel, globalReqs <-chan *ssh.Request, authz Authorizer, logger *logging.Logger, cfg Config, metrics *Metrics) {
+	if authz == nil {
+		authz = AllowAll{}
+	}
+	if logger == nil {
+		logger = logging.New()
+	}
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+	logger = logger.With("remote_addr", serverConn.RemoteAddr().String())
+
+	metrics.connectionOpened()
+	defer metrics.connectionClosed()
+
+	// ctx is cancelled either by a shutdown signal, a keepalive timeout, or
+	// by serverConn.Wait returning (the peer disconnected), so every
+	// codepath that needs an orderly teardown can watch the same signal
+	// instead of relying on listener/pipe close side effects.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		serverConn.Wait()
+		cancel()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, shutdownSignals...)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case sig := <-sigCh:
+			logger.Infof("Received %v, shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if cfg.KeepaliveInterval > 0 {
+		go runServerKeepalive(ctx, serverConn, cfg, cancel, logger)
+	}
+
+	procs := &processRegistry{}
+
 	var wg sync.WaitGroup
+	var chanID int
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		for newChan := range newChans {
-			newChan := newChan
+			if ctx.Err() != nil {
+				// Shutting down: stop accepting new work.
+				newChan.Reject(ssh.ConnectionFailed, "daemon is shutting down")
+				continue
+			}
+			chanID++
+			newChan, chLogger := newChan, logger.With("channel_id", chanID).With("channel_type", newChan.ChannelType())
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				handleNewChannel(newChan)
+				handleNewChannel(serverConn, newChan, authz, procs, chLogger, cfg, metrics)
 			}()
 		}
 	}()
 
 	forwards := make(map[forwardKey]*net.TCPListener)
-	defer func() {
-		for _, listener := range forwards {
-			listener.Close()
+	streamForwards := make(map[string]*net.UnixListener)
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case globalReq, ok := <-globalReqs:
+			if !ok {
+				break loop
+			}
+			if ctx.Err() != nil {
+				globalReq.Reply(false, nil)
+				continue
+			}
+			handleGlobalRequest(serverConn, globalReq, forwards, streamForwards, authz, logger, cfg, metrics, &wg)
 		}
+	}
+
+	// Initiate an orderly shutdown: stop accepting new forwarded
+	// connections, give running child processes a chance to exit
+	// cleanly, then close the connection.
+	for _, listener := range forwards {
+		listener.Close()
+		metrics.forwardClosed()
+	}
+	for socketPath, listener := range streamForwards {
+		listener.Close()
+		os.Remove(socketPath)
+	}
+	procs.signal(unix.SIGHUP)
+	serverConn.Close()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
 	}()
+	select {
+	case <-drained:
+	case <-time.After(shutdownDrainTimeout):
+		logger.Warnf("Timed out after %v waiting for sessions to exit", shutdownDrainTimeout)
+	}
+}
 
-	for globalReq := range globalReqs {
-		handleGlobalRequest(serverConn, globalReq, forwards)
+// runServerKeepalive periodically probes serverConn with a
+// keepalive@openssh.com global request, calling cancel once
+// cfg.KeepaliveMaxMissed consecutive probes go unanswered.
+func runServerKeepalive(ctx context.Context, serverConn *ssh.ServerConn, cfg Config, cancel context.CancelFunc, logger *logging.Logger) {
+	maxMissed := cfg.KeepaliveMaxMissed
+	if maxMissed <= 0 {
+		maxMissed = 1
+	}
+
+	ticker := time.NewTicker(cfg.KeepaliveInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, _, err := serverConn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				missed++
+				logger.Warnf("Keepalive probe failed (%d/%d): %v", missed, maxMissed, err)
+				if missed >= maxMissed {
+					logger.Warnf("No keepalive reply after %d probes, closing connection", missed)
+					cancel()
+					return
+				}
+				continue
+			}
+			missed = 0
+		}
 	}
-	wg.Wait()
 }
 
-func handleGlobalRequest(serverConn *ssh.ServerConn, req *ssh.Request, forwards map[forwardKey]*net.TCPListener) {
+func handleGlobalRequest(serverConn *ssh.ServerConn, req *ssh.Request, forwards map[forwardKey]*net.TCPListener, streamForwards map[string]*net.UnixListener, authz Authorizer, logger *logging.Logger, cfg Config, metrics *Metrics, wg *sync.WaitGroup) {
 	switch req.Type {
 	case "tcpip-forward":
-		var p tcpipForwardPayload
+		var p sshchan.TCPIPForwardPayload
 		if err := ssh.Unmarshal(req.Payload, &p); err != nil {
 			req.Reply(false, nil)
 			return
 		}
+		fwdLogger := logger.With("forward", net.JoinHostPort(p.BindAddress, strconv.FormatUint(uint64(p.BindPort), 10)))
+		if err := authz.AuthorizeTCPIPForward(serverConn, p.BindAddress, p.BindPort); err != nil {
+			fwdLogger.Warnf("tcpip-forward rejected: %v", err)
+			req.Reply(false, nil)
+			return
+		}
+
+		// The listener below only ever binds localhost, regardless of
+		// p.BindAddress, so a permitlisten entry naming any other host
+		// would be checked against an address nothing is ever actually
+		// bound to. Reject those up front instead, so a permitlisten
+		// host component that passed authorization above is guaranteed
+		// to describe where the forward really listens.
+		if !isLoopbackHost(p.BindAddress) {
+			fwdLogger.Warnf("tcpip-forward rejected: bind address %q is not localhost", p.BindAddress)
+			req.Reply(false, nil)
+			return
+		}
+
+		// Reject a second forward for the same bind address/port instead of
+		// silently clobbering the map entry and leaking the original
+		// listener and its serveForwards goroutine.
+		if p.BindPort != 0 {
+			if _, ok := forwards[forwardKey{BindAddress: p.BindAddress, BindPort: p.BindPort}]; ok {
+				req.Reply(false, nil)
+				return
+			}
+		}
 
 		// Only allow binding to localhost.
 		listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", uint16(p.BindPort)))
@@ -79,17 +271,23 @@ func handleGlobalRequest(serverConn *ssh.ServerConn, req *ssh.Request, forwards
 			BindPort:    port,
 		}
 		forwards[key] = listener.(*net.TCPListener)
+		metrics.forwardOpened()
 
-		go serveForwards(serverConn, listener.(*net.TCPListener))
+		go serveForwards(serverConn, listener.(*net.TCPListener), cfg, metrics, wg)
 
-		req.Reply(true, ssh.Marshal(&tcpipForwardSuccessPayload{BindPort: port}))
+		req.Reply(true, ssh.Marshal(&sshchan.TCPIPForwardSuccessPayload{BindPort: port}))
 
 	case "cancel-tcpip-forward":
-		var p cancelTCPIPForwardPayload
+		var p sshchan.CancelTCPIPForwardPayload
 		if err := ssh.Unmarshal(req.Payload, &p); err != nil {
 			req.Reply(false, nil)
 			return
 		}
+		if err := authz.AuthorizeTCPIPForward(serverConn, p.BindAddress, p.BindPort); err != nil {
+			logger.With("forward", net.JoinHostPort(p.BindAddress, strconv.FormatUint(uint64(p.BindPort), 10))).Warnf("cancel-tcpip-forward rejected: %v", err)
+			req.Reply(false, nil)
+			return
+		}
 		key := forwardKey{
 			BindAddress: p.BindAddress,
 			BindPort:    p.BindPort,
@@ -101,6 +299,55 @@ func handleGlobalRequest(serverConn *ssh.ServerConn, req *ssh.Request, forwards
 		}
 		listener.Close()
 		delete(forwards, key)
+		metrics.forwardClosed()
+		req.Reply(true, nil)
+
+	case "streamlocal-forward@openssh.com":
+		var p streamLocalForwardPayload
+		if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+
+		// Reject a second forward for the same socket path instead of
+		// silently clobbering the map entry and leaking the original
+		// listener and its serveStreamForwards goroutine.
+		if _, ok := streamForwards[p.SocketPath]; ok {
+			req.Reply(false, nil)
+			return
+		}
+
+		// Remove a stale socket file left behind by a previous run before
+		// binding, the same way OpenSSH's sshd does.
+		os.Remove(p.SocketPath)
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: p.SocketPath})
+		if err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		streamForwards[p.SocketPath] = listener
+
+		go serveStreamForwards(serverConn, listener, p.SocketPath, cfg, metrics, wg)
+
+		req.Reply(true, nil)
+
+	case "cancel-streamlocal-forward@openssh.com":
+		var p cancelStreamLocalForwardPayload
+		if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		listener, ok := streamForwards[p.SocketPath]
+		if !ok {
+			req.Reply(false, nil)
+			return
+		}
+		listener.Close()
+		os.Remove(p.SocketPath)
+		delete(streamForwards, p.SocketPath)
+		req.Reply(true, nil)
+
+	case "keepalive@openssh.com":
 		req.Reply(true, nil)
 
 	default:
@@ -108,20 +355,24 @@ func handleGlobalRequest(serverConn *ssh.ServerConn, req *ssh.Request, forwards
 	}
 }
 
-func serveForwards(serverConn *ssh.ServerConn, listener *net.TCPListener) {
+func serveForwards(serverConn *ssh.ServerConn, listener *net.TCPListener, cfg Config, metrics *Metrics, wg *sync.WaitGroup) {
 	for {
 		conn, err := listener.AcceptTCP()
 		if err != nil {
 			return
 		}
-		go handleNewForward(serverConn, conn)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleNewForward(serverConn, conn, cfg, metrics)
+		}()
 	}
 }
 
-func handleNewForward(serverConn *ssh.ServerConn, conn *net.TCPConn) {
+func handleNewForward(serverConn *ssh.ServerConn, conn *net.TCPConn, cfg Config, metrics *Metrics) {
 	localAddr := conn.LocalAddr().(*net.TCPAddr)
 	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
-	ch, reqs, err := serverConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&forwardedTCPIPPayload{
+	ch, reqs, err := serverConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&sshchan.ForwardedTCPIPPayload{
 		ConnectedHost:  "localhost", // localAddr.IP.String(),
 		ConnectedPort:  uint32(localAddr.Port),
 		OriginatorHost: remoteAddr.IP.String(),
@@ -131,25 +382,66 @@ func handleNewForward(serverConn *ssh.ServerConn, conn *net.TCPConn) {
 		conn.Close()
 		return
 	}
-	serveForward(ch, reqs, conn)
+	metrics.channelOpened("forwarded-tcpip")
+	defer metrics.channelClosed("forwarded-tcpip")
+	serveForward(ch, reqs, conn, cfg.IdleTimeout, "forwarded-tcpip", metrics)
+}
+
+func serveStreamForwards(serverConn *ssh.ServerConn, listener *net.UnixListener, socketPath string, cfg Config, metrics *Metrics, wg *sync.WaitGroup) {
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleNewStreamForward(serverConn, conn, socketPath, cfg, metrics)
+		}()
+	}
+}
+
+func handleNewStreamForward(serverConn *ssh.ServerConn, conn *net.UnixConn, socketPath string, cfg Config, metrics *Metrics) {
+	ch, reqs, err := serverConn.OpenChannel("forwarded-streamlocal@openssh.com", ssh.Marshal(&forwardedStreamLocalPayload{
+		SocketPath: socketPath,
+	}))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	metrics.channelOpened("forwarded-streamlocal@openssh.com")
+	defer metrics.channelClosed("forwarded-streamlocal@openssh.com")
+	serveForward(ch, reqs, conn, cfg.IdleTimeout, "forwarded-streamlocal@openssh.com", metrics)
 }
 
-func handleNewChannel(newChan ssh.NewChannel) {
+func handleNewChannel(serverConn *ssh.ServerConn, newChan ssh.NewChannel, authz Authorizer, procs *processRegistry, logger *logging.Logger, cfg Config, metrics *Metrics) {
 	switch newChan.ChannelType() {
 	case "session":
+		if err := authz.AuthorizeSession(serverConn); err != nil {
+			logger.Warnf("session rejected: %v", err)
+			newChan.Reject(ssh.Prohibited, err.Error())
+			return
+		}
 		ch, reqs, err := newChan.Accept()
 		if err != nil {
 			return
 		}
-		serveSession(ch, reqs)
+		serveSession(serverConn, ch, reqs, authz, procs, logger, cfg, metrics)
 	case "direct-tcpip":
-		var p directTCPIPPayload
+		var p sshchan.DirectTCPIPPayload
 		if err := ssh.Unmarshal(newChan.ExtraData(), &p); err != nil {
 			newChan.Reject(ssh.Prohibited, fmt.Sprintf("corrupted direct-tcpip payload: %v", err))
 			return
 		}
+		logger = logger.With("forward", net.JoinHostPort(p.TargetHost, strconv.FormatUint(uint64(p.TargetPort), 10)))
+		if err := authz.AuthorizeDirectTCPIP(serverConn, p.TargetHost, p.TargetPort); err != nil {
+			logger.Warnf("direct-tcpip rejected: %v", err)
+			newChan.Reject(ssh.Prohibited, err.Error())
+			return
+		}
 		conn, err := net.Dial("tcp", net.JoinHostPort(p.TargetHost, strconv.FormatUint(uint64(p.TargetPort), 10)))
 		if err != nil {
+			logger.Warnf("direct-tcpip dial failed: %v", err)
 			newChan.Reject(ssh.ConnectionFailed, fmt.Sprintf("direct-tcpip: %v", err))
 			return
 		}
@@ -158,13 +450,43 @@ func handleNewChannel(newChan ssh.NewChannel) {
 			conn.Close()
 			return
 		}
-		serveForward(ch, reqs, conn.(*net.TCPConn))
+		metrics.channelOpened("direct-tcpip")
+		defer metrics.channelClosed("direct-tcpip")
+		serveForward(ch, reqs, conn, cfg.IdleTimeout, "direct-tcpip", metrics)
+	case "direct-streamlocal@openssh.com":
+		var p directStreamLocalPayload
+		if err := ssh.Unmarshal(newChan.ExtraData(), &p); err != nil {
+			newChan.Reject(ssh.Prohibited, fmt.Sprintf("corrupted direct-streamlocal payload: %v", err))
+			return
+		}
+		logger = logger.With("forward", p.SocketPath)
+		conn, err := net.Dial("unix", p.SocketPath)
+		if err != nil {
+			logger.Warnf("direct-streamlocal dial failed: %v", err)
+			newChan.Reject(ssh.ConnectionFailed, fmt.Sprintf("direct-streamlocal: %v", err))
+			return
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		metrics.channelOpened("direct-streamlocal@openssh.com")
+		defer metrics.channelClosed("direct-streamlocal@openssh.com")
+		serveForward(ch, reqs, conn, cfg.IdleTimeout, "direct-streamlocal@openssh.com", metrics)
 	default:
+		logger.Warnf("rejecting unsupported channel type: %s", newChan.ChannelType())
 		newChan.Reject(ssh.UnknownChannelType, fmt.Sprintf("unsupported channel type: %s", newChan.ChannelType()))
 	}
 }
 
-func serveForward(ch ssh.Channel, reqs <-chan *ssh.Request, conn *net.TCPConn) {
+// serveForward bridges an SSH forwarding channel (direct-tcpip,
+// forwarded-tcpip, direct-streamlocal@openssh.com, or
+// forwarded-streamlocal@openssh.com) with the corresponding local
+// connection, until either side is done. If idleTimeout is non-zero, both
+// sides are closed once neither has carried traffic for that long. Bytes
+// copied in each direction are reported to metrics under channelType.
+func serveForward(ch ssh.Channel, reqs <-chan *ssh.Request, conn io.ReadWriteCloser, idleTimeout time.Duration, channelType string, metrics *Metrics) {
 	defer ch.Close()
 	defer conn.Close()
 
@@ -174,17 +496,31 @@ func serveForward(ch ssh.Channel, reqs <-chan *ssh.Request, conn *net.TCPConn) {
 		}
 	}()
 
+	touch := func() {}
+	if idleTimeout > 0 {
+		monitor := newIdleMonitor(idleTimeout)
+		defer monitor.stop()
+		go monitor.watch(func() {
+			ch.Close()
+			conn.Close()
+		})
+		touch = monitor.touch
+	}
+
+	rx := func(n int) { metrics.addBytes(channelType, "rx", n) }
+	tx := func(n int) { metrics.addBytes(channelType, "tx", n) }
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		io.Copy(ch, conn)
-		ch.CloseWrite()
+		// conn -> ch: bytes heading to the SSH peer.
+		sshchan.CopyHalf(touchWriter{countingWriter{ch, tx}, touch}, touchReader{conn, touch})
 	}()
 	go func() {
 		defer wg.Done()
-		io.Copy(conn, ch)
-		conn.CloseWrite()
+		// ch -> conn: bytes received from the SSH peer.
+		sshchan.CopyHalf(touchWriter{conn, touch}, touchReader{countingReader{ch, rx}, touch})
 	}()
 	wg.Wait()
 }
@@ -193,13 +529,20 @@ type windowSize struct {
 	Width, Height uint32
 }
 
-func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+func serveSession(serverConn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request, authz Authorizer, procs *processRegistry, logger *logging.Logger, cfg Config, metrics *Metrics) {
 	defer ch.Close()
 
 	// procCh is initially nil. It is set to a valid channel when a process
 	// starts. The channel is closed when it finishes.
 	var procCh <-chan struct{}
 
+	var agentFwd *agentForward
+	defer func() {
+		if agentFwd != nil {
+			agentFwd.Close()
+		}
+	}()
+
 	var extraEnvs []string
 	wantPty := false
 	windowEvents := make(chan windowSize, 1)
@@ -228,6 +571,9 @@ func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 					if procCh != nil {
 						return errors.New("process already started")
 					}
+					if _, err := authz.AuthorizeCommand(serverConn, ""); err != nil {
+						return err
+					}
 					wantPty = true
 					extraEnvs = append(extraEnvs, fmt.Sprintf("TERM=%s", p.TerminalName))
 					pushWindowEvent(windowSize{Width: p.WidthInChars, Height: p.HeightInChars})
@@ -235,7 +581,7 @@ func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 				case "env":
 					var p envPayload
 					if err := ssh.Unmarshal(req.Payload, &p); err != nil {
-						logging.Errorf("Failed to parse %s: %v", req.Type, err)
+						logger.Errorf("Failed to parse %s: %v", req.Type, err)
 						return err
 					}
 					if procCh != nil {
@@ -243,12 +589,36 @@ func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 					}
 					extraEnvs = append(extraEnvs, fmt.Sprintf("%s=%s", p.VariableName, p.VariableValue))
 					return nil
-				case "shell":
+				case "auth-agent-req@openssh.com":
 					if procCh != nil {
 						return errors.New("process already started")
 					}
+					if agentFwd != nil {
+						return errors.New("agent forwarding already requested")
+					}
 					var err error
-					procCh, err = runCommand("/bin/bash", []string{"-l"}, extraEnvs, ch, wantPty, windowEvents)
+					agentFwd, err = startAgentForward(serverConn)
+					if err != nil {
+						return fmt.Errorf("failed to start agent forward: %w", err)
+					}
+					extraEnvs = append(extraEnvs, fmt.Sprintf("SSH_AUTH_SOCK=%s", agentFwd.SocketPath()))
+					return nil
+				case "shell":
+					if procCh != nil {
+						return errors.New("process already started")
+					}
+					command, err := authz.AuthorizeCommand(serverConn, "")
+					if err != nil {
+						return err
+					}
+					if command == "" {
+						procCh, err = runCommand(procs, cfg, metrics, "/bin/bash", []string{"-l"}, extraEnvs, ch, wantPty, windowEvents)
+						return err
+					}
+					// A force-command replaces the login shell with the
+					// forced command; the original (empty) command isn't
+					// meaningful, so SSH_ORIGINAL_COMMAND is left unset.
+					procCh, err = runCommand(procs, cfg, metrics, "/bin/bash", []string{"-c", command}, extraEnvs, ch, wantPty, windowEvents)
 					return err
 				case "exec":
 					var p execPayload
@@ -258,8 +628,40 @@ func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 					if procCh != nil {
 						return errors.New("process already started")
 					}
-					var err error
-					procCh, err = runCommand("/bin/bash", []string{"-c", p.Command}, extraEnvs, ch, wantPty, windowEvents)
+					command, err := authz.AuthorizeCommand(serverConn, p.Command)
+					if err != nil {
+						return err
+					}
+					if command != p.Command {
+						extraEnvs = append(extraEnvs, fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s", p.Command))
+					}
+					procCh, err = runCommand(procs, cfg, metrics, "/bin/bash", []string{"-c", command}, extraEnvs, ch, wantPty, windowEvents)
+					return err
+				case "subsystem":
+					var p subsystemPayload
+					if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+						return err
+					}
+					if procCh != nil {
+						return errors.New("process already started")
+					}
+					if p.Name != "sftp" {
+						return fmt.Errorf("unsupported subsystem: %s", p.Name)
+					}
+					// A subsystem request bypasses the command rewriting
+					// AuthorizeCommand does for "exec"/"shell": there's no
+					// command to swap out for a force-command, only a
+					// built-in SFTP server with unrestricted filesystem
+					// access. So a session restricted to a force-command
+					// must not be allowed to start one.
+					command, err := authz.AuthorizeCommand(serverConn, "")
+					if err != nil {
+						return err
+					}
+					if command != "" {
+						return errors.New("subsystem requests are not permitted for a session restricted to a force-command")
+					}
+					procCh, err = startSFTPSubsystem(ch)
 					return err
 				case "window-change":
 					var p windowChangePayload
@@ -269,6 +671,7 @@ func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 					if procCh == nil {
 						return errors.New("process not started")
 					}
+					metrics.ptyResize()
 					pushWindowEvent(windowSize{Width: p.WidthInChars, Height: p.HeightInChars})
 					return nil
 				default:
@@ -276,7 +679,7 @@ func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 				}
 			}()
 			if err != nil {
-				logging.Errorf("Channel request %s rejected: %v", req.Type, err)
+				logger.Errorf("Channel request %s rejected: %v", req.Type, err)
 				req.Reply(false, nil)
 			} else {
 				req.Reply(true, nil)
@@ -285,23 +688,46 @@ func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
 	}
 }
 
-func runCommand(name string, args []string, extraEnvs []string, ch ssh.Channel, wantPty bool, windowEvents <-chan windowSize) (<-chan struct{}, error) {
+func runCommand(procs *processRegistry, cfg Config, metrics *Metrics, name string, args []string, extraEnvs []string, ch ssh.Channel, wantPty bool, windowEvents <-chan windowSize) (<-chan struct{}, error) {
+	var monitor *idleMonitor
+	touch := func() {}
+	if cfg.IdleTimeout > 0 {
+		monitor = newIdleMonitor(cfg.IdleTimeout)
+		touch = monitor.touch
+	}
+
 	var proc *exec.Cmd
 	var err error
 	if wantPty {
-		proc, err = startCommandWithPty(name, args, extraEnvs, ch, windowEvents)
+		proc, err = startCommandWithPty(name, args, extraEnvs, ch, windowEvents, touch, metrics)
 	} else {
-		proc, err = startCommandNoPty(name, args, extraEnvs, ch)
+		proc, err = startCommandNoPty(name, args, extraEnvs, ch, touch, metrics)
 	}
 	if err != nil {
 		return nil, err
 	}
+	procs.add(proc.Process)
+	metrics.sessionOpened()
+
+	if monitor != nil {
+		// Idle session: SIGHUP the child the same way an explicit daemon
+		// shutdown does, and close the channel so the client sees it end.
+		go monitor.watch(func() {
+			proc.Process.Signal(unix.SIGHUP)
+			ch.Close()
+		})
+	}
 
 	procCh := make(chan struct{})
 	go func() {
 		defer close(procCh)
+		defer procs.remove(proc.Process)
+		if monitor != nil {
+			defer monitor.stop()
+		}
 
 		proc.Wait()
+		metrics.sessionClosed(proc.ProcessState.ExitCode())
 		status := proc.ProcessState.Sys().(syscall.WaitStatus)
 		if status.Signaled() {
 			payload := ssh.Marshal(&exitSignalPayload{
@@ -321,7 +747,7 @@ func runCommand(name string, args []string, extraEnvs []string, ch ssh.Channel,
 	return procCh, nil
 }
 
-func startCommandWithPty(name string, args []string, extraEnvs []string, ch ssh.Channel, windowEvents <-chan windowSize) (*exec.Cmd, error) {
+func startCommandWithPty(name string, args []string, extraEnvs []string, ch ssh.Channel, windowEvents <-chan windowSize, touch func(), metrics *Metrics) (*exec.Cmd, error) {
 	ptmx, tty, err := pty.Open()
 	if err != nil {
 		return nil, err
@@ -343,8 +769,8 @@ func startCommandWithPty(name string, args []string, extraEnvs []string, ch ssh.
 	}
 
 	// Relay stdio.
-	go io.Copy(ch, ptmx)
-	go io.Copy(ptmx, ch)
+	go io.Copy(touchWriter{countingWriter{ch, func(n int) { metrics.addBytes("session", "tx", n) }}, touch}, touchReader{ptmx, touch})
+	go io.Copy(touchWriter{ptmx, touch}, touchReader{countingReader{ch, func(n int) { metrics.addBytes("session", "rx", n) }}, touch})
 
 	// Relay window events.
 	go func() {
@@ -362,7 +788,7 @@ func startCommandWithPty(name string, args []string, extraEnvs []string, ch ssh.
 	return proc, nil
 }
 
-func startCommandNoPty(name string, args []string, extraEnvs []string, ch ssh.Channel) (*exec.Cmd, error) {
+func startCommandNoPty(name string, args []string, extraEnvs []string, ch ssh.Channel, touch func(), metrics *Metrics) (*exec.Cmd, error) {
 	proc := exec.Command(name, args...)
 	proc.Env = append(os.Environ(), extraEnvs...)
 	stdin, _ := proc.StdinPipe()
@@ -374,12 +800,12 @@ func startCommandNoPty(name string, args []string, extraEnvs []string, ch ssh.Ch
 
 	// Stdin needs special cares since channel input might not be closed.
 	go func() {
-		io.Copy(stdin, ch)
+		io.Copy(touchWriter{stdin, touch}, touchReader{countingReader{ch, func(n int) { metrics.addBytes("session", "rx", n) }}, touch})
 		stdin.Close()
 	}()
 	// Stdout needs special cares to relay EOF.
 	go func() {
-		io.Copy(ch, stdout)
+		io.Copy(touchWriter{countingWriter{ch, func(n int) { metrics.addBytes("session", "tx", n) }}, touch}, touchReader{stdout, touch})
 		ch.CloseWrite()
 	}()
 	return proc, nil
@@ -0,0 +1,126 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package enter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKeyEntry is one line of an authorized_keys file: a key plus the
+// restrictions (if any) carried by its sshd(8)-style options, e.g.
+// `command="..."` or `permitopen="..."`.
+type authorizedKeyEntry struct {
+	key         ssh.PublicKey
+	permissions *ssh.Permissions
+}
+
+// authorizedKeys holds the entries read from an authorized_keys file, for
+// use by a ssh.ServerConfig.PublicKeyCallback.
+type authorizedKeys struct {
+	entries []authorizedKeyEntry
+}
+
+// loadAuthorizedKeys parses an OpenSSH authorized_keys file. A missing file
+// is not an error: it simply yields no authorized keys, so that public-key
+// authentication quietly falls back to keyboard-interactive.
+func loadAuthorizedKeys(path string) (*authorizedKeys, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &authorizedKeys{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []authorizedKeyEntry
+	for len(data) > 0 {
+		key, _, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		permissions, err := parseAuthorizedKeyOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, authorizedKeyEntry{key: key, permissions: permissions})
+		data = rest
+	}
+	return &authorizedKeys{entries: entries}, nil
+}
+
+// Authorized reports whether key matches one of the authorized keys, and if
+// so, the ssh.Permissions its authorized_keys options grant it. The
+// returned Permissions is what the connection's PublicKeyCallback should
+// return, so that force-command/source-address/permitopen/permitlisten
+// restrictions actually reach the daemon's own Authorizer instead of being
+// silently dropped.
+func (a *authorizedKeys) Authorized(key ssh.PublicKey) (*ssh.Permissions, bool) {
+	marshaled := key.Marshal()
+	for _, e := range a.entries {
+		if bytes.Equal(e.key.Marshal(), marshaled) {
+			return e.permissions, true
+		}
+	}
+	return nil, false
+}
+
+// parseAuthorizedKeyOptions converts the sshd(8)-style options
+// ssh.ParseAuthorizedKey returns alongside a key (e.g. `command="..."`,
+// `permitopen="..."`) into the CriticalOptions/Extensions schema
+// daemonsshd.PermissionsAuthorizer enforces. Options it doesn't recognize
+// (e.g. "no-pty", which doesn't apply here) are ignored, matching OpenSSH's
+// own handling of option names a given context doesn't support.
+//
+// permitopen/permitlisten may be repeated, one host:port per occurrence;
+// repeats are merged into PermissionsAuthorizer's single comma-separated
+// entry.
+func parseAuthorizedKeyOptions(options []string) (*ssh.Permissions, error) {
+	var permissions ssh.Permissions
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i != -1 {
+			name, value = option[:i], option[i+1:]
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s option %q: %w", name, option, err)
+			}
+			value = unquoted
+		}
+		switch name {
+		case "command":
+			setCriticalOption(&permissions, "force-command", value)
+		case "source-address":
+			setCriticalOption(&permissions, "source-address", value)
+		case "permitopen":
+			appendPermitListEntry(&permissions, "permitopen", value)
+		case "permitlisten":
+			appendPermitListEntry(&permissions, "permitlisten", value)
+		}
+	}
+	return &permissions, nil
+}
+
+func setCriticalOption(permissions *ssh.Permissions, name, value string) {
+	if permissions.CriticalOptions == nil {
+		permissions.CriticalOptions = map[string]string{}
+	}
+	permissions.CriticalOptions[name] = value
+}
+
+func appendPermitListEntry(permissions *ssh.Permissions, extension, value string) {
+	if permissions.Extensions == nil {
+		permissions.Extensions = map[string]string{}
+	}
+	if existing, ok := permissions.Extensions[extension]; ok {
+		value = existing + "," + value
+	}
+	permissions.Extensions[extension] = value
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package enter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func mustPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	return key
+}
+
+func TestLoadAuthorizedKeysMissingFile(t *testing.T) {
+	keys, err := loadAuthorizedKeys(filepath.Join(t.TempDir(), "does-not-exist"))
+	if err != nil {
+		t.Fatalf("loadAuthorizedKeys: %v", err)
+	}
+	if _, ok := keys.Authorized(mustPublicKey(t)); ok {
+		t.Error("Authorized() = true for an empty authorizedKeys, want false")
+	}
+}
+
+func TestAuthorizedKeysAuthorized(t *testing.T) {
+	authorized := mustPublicKey(t)
+	other := mustPublicKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	line := string(ssh.MarshalAuthorizedKey(authorized))
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	keys, err := loadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("loadAuthorizedKeys: %v", err)
+	}
+	if _, ok := keys.Authorized(authorized); !ok {
+		t.Error("Authorized() = false for a key present in authorized_keys, want true")
+	}
+	if _, ok := keys.Authorized(other); ok {
+		t.Error("Authorized() = true for a key absent from authorized_keys, want false")
+	}
+}
+
+func TestAuthorizedKeysOptions(t *testing.T) {
+	authorized := mustPublicKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	line := fmt.Sprintf(`command="/bin/ls",source-address="10.0.0.0/8",permitopen="localhost:22",permitopen="localhost:80" %s`,
+		ssh.MarshalAuthorizedKey(authorized))
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	keys, err := loadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("loadAuthorizedKeys: %v", err)
+	}
+	permissions, ok := keys.Authorized(authorized)
+	if !ok {
+		t.Fatalf("Authorized() = false for a key present in authorized_keys, want true")
+	}
+	if got, want := permissions.CriticalOptions["force-command"], "/bin/ls"; got != want {
+		t.Errorf("force-command = %q, want %q", got, want)
+	}
+	if got, want := permissions.CriticalOptions["source-address"], "10.0.0.0/8"; got != want {
+		t.Errorf("source-address = %q, want %q", got, want)
+	}
+	if got, want := permissions.Extensions["permitopen"], "localhost:22,localhost:80"; got != want {
+		t.Errorf("permitopen = %q, want %q", got, want)
+	}
+}
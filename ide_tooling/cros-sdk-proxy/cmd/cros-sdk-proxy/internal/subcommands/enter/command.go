@@ -15,9 +15,11 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sys/unix"
 
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/chroot"
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/logging"
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/daemon"
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/enter/relaysshd"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/askpasssrv"
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/pipe"
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshd"
 )
@@ -34,20 +36,46 @@ var flagLoopback = &cli.BoolFlag{
 	Usage:  "executes a local shell instead of entering chroot (for testing only)",
 }
 
+var flagNoAgentForward = &cli.BoolFlag{
+	Name:  "no-agent-forward",
+	Usage: "disables forwarding the ssh-agent into the chroot",
+}
+
+var flagAuthorizedKeys = &cli.StringFlag{
+	Name:  "authorized-keys",
+	Usage: "path to an authorized_keys file enabling public-key authentication (default: ~/.ssh/authorized_keys)",
+}
+
 var Command = &cli.Command{
 	Name: "enter",
 	Flags: []cli.Flag{
 		flagRootDir,
 		flagLoopback,
+		flagNoAgentForward,
+		flagAuthorizedKeys,
 	},
 	Usage: "enters chroot",
 	Action: func(c *cli.Context) error {
 		rootDir := c.String(flagRootDir.Name)
 		loopback := c.Bool(flagLoopback.Name)
+		noAgentForward := c.Bool(flagNoAgentForward.Name)
+
+		authorizedKeysPath := c.String(flagAuthorizedKeys.Name)
+		if authorizedKeysPath == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+			authorizedKeysPath = filepath.Join(home, ".ssh", "authorized_keys")
+		}
+		authKeys, err := loadAuthorizedKeys(authorizedKeysPath)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", authorizedKeysPath, err)
+		}
 
 		logging.Info("Starting relay (outside chroot)")
 
-		askpass, err := newAskpassServer()
+		askpass, err := askpasssrv.New()
 		if err != nil {
 			return err
 		}
@@ -65,58 +93,21 @@ var Command = &cli.Command{
 		}()
 
 		serverConfig := &ssh.ServerConfig{
-			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-				// Open the self binary.
-				exePath, err := os.Executable()
-				if err != nil {
-					return nil, err
-				}
-
-				exeFile, err := os.Open(exePath)
-				if err != nil {
-					return nil, err
-				}
-				defer exeFile.Close()
-
-				// Create a socketpair for communication.
-				// SOCK_CLOEXEC is important to prevent child processes from
-				// inheriting sockets. See comments for syscall.ForkLock for
-				// details.
-				fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
-				if err != nil {
-					return nil, err
-				}
-				relaySocket := os.NewFile(uintptr(fds[0]), "")
-				daemonSocket := os.NewFile(uintptr(fds[1]), "")
-				defer func() {
-					if relaySocket != nil {
-						relaySocket.Close()
-					}
-				}()
-				defer daemonSocket.Close()
-
-				// Start cros_sdk.
-				args := []string{
-					"sudo", "--askpass",
-					"env", fmt.Sprintf("DEPOT_TOOLS=%s/src/chromium/depot_tools", rootDir),
-					filepath.Join(rootDir, "chromite/bin/cros_sdk")}
-				if loopback {
-					args = nil
-				}
-				args = append(args, "bash", "-c", `exec 3<&0 0<&1; exec -a "$0" /proc/self/fd/3 "$@"`, os.Args[0], daemon.Command.Name)
-				proc := exec.Command(args[0], args[1:]...)
-				proc.Env = append(os.Environ(), fmt.Sprintf("SUDO_ASKPASS=%s", askpass.ClientPath()))
-				proc.Stdin = exeFile       // stdin: self exe
-				proc.Stdout = daemonSocket // stdout: socket
-				proc.Stderr = os.Stderr    // stderr: pass through
-				if err := proc.Start(); err != nil {
-					return nil, err
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				// This only checks whether key would be acceptable: per
+				// x/crypto/ssh's docs, PublicKeyCallback is also invoked
+				// during the unsigned query phase of publickey auth, before
+				// the client has proven possession of the private key, so
+				// it must not have side effects like starting the
+				// privileged chroot process. That happens once the
+				// signature has actually been verified, below.
+				permissions, ok := authKeys.Authorized(key)
+				if !ok {
+					return nil, fmt.Errorf("key not present in %s", authorizedKeysPath)
 				}
-
-				// Close the daemon socket now so that we can read EOF from
-				// relaySocket when the subprocess exits.
-				daemonSocket.Close()
-
+				return permissions, nil
+			},
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
 				// Start the auth goroutine.
 				go func() {
 					for {
@@ -154,18 +145,25 @@ var Command = &cli.Command{
 					}
 				}()
 
-				// Wait until stdout becomes readable.
-				unix.Poll([]unix.PollFd{{Fd: int32(relaySocket.Fd()), Events: unix.POLLIN}}, -1)
+				var err error
+				proc, procStdio, err = chroot.Start(
+					chroot.Args(rootDir, loopback, []string{"--askpass"}, nil),
+					[]string{fmt.Sprintf("SUDO_ASKPASS=%s", askpass.ClientPath())})
 
 				// Unblock the auth goroutine.
 				askpass.Listener().Close()
 
-				procStdio = relaySocket
-				relaySocket = nil
+				if err != nil {
+					return nil, err
+				}
 				return nil, nil
 			},
 		}
-		serverConfig.AddHostKey(sshd.MockSigner)
+		relayHostKey, err := sshd.NewEphemeralSigner()
+		if err != nil {
+			return fmt.Errorf("failed to generate relay host key: %w", err)
+		}
+		serverConfig.AddHostKey(relayHostKey)
 
 		server, serverNewChans, serverGlobalReqs, err := ssh.NewServerConn(pipe.NewConn(os.Stdin, os.Stdout), serverConfig)
 		if err != nil {
@@ -173,16 +171,54 @@ var Command = &cli.Command{
 		}
 		defer server.Close()
 
+		// NewServerConn only returns once authentication has actually
+		// succeeded. KeyboardInteractiveCallback already started the
+		// chroot process itself (it needs the askpass round trip to have
+		// happened first); a nil proc here means the client authenticated
+		// via public key instead, so start it now that the signature has
+		// been verified.
+		if proc == nil {
+			// The connection authenticated via public key, so propagate
+			// whatever restrictions its authorized_keys entry carried down
+			// to the daemon: its own ServerConn has no authentication of
+			// its own to derive them from otherwise.
+			daemonArgs, err := daemon.EncodePermissionsArgs(server.Permissions)
+			if err != nil {
+				return err
+			}
+			proc, procStdio, err = chroot.Start(
+				chroot.Args(rootDir, loopback, []string{"-n"}, daemonArgs), nil)
+			if err != nil {
+				return fmt.Errorf("sudo requires a password; configure a passwordless sudoers rule for cros_sdk, or authenticate with keyboard-interactive instead: %w", err)
+			}
+		}
+
+		knownHosts, err := sshd.DefaultKnownHostsPath()
+		if err != nil {
+			return fmt.Errorf("failed to determine known_hosts path: %w", err)
+		}
+		hostKeyCallback, err := sshd.TOFUHostKeyCallback(knownHosts, rootDir)
+		if err != nil {
+			return fmt.Errorf("failed to set up daemon host key pinning: %w", err)
+		}
+
 		clientConfig := &ssh.ClientConfig{
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			HostKeyCallback: hostKeyCallback,
 		}
-		client, clientNewChans, clientGlobalReqs, err := ssh.NewClientConn(pipe.NewConn(procStdio, procStdio), "", clientConfig)
+		client, clientNewChans, clientGlobalReqs, err := ssh.NewClientConn(pipe.NewConn(procStdio, procStdio), rootDir, clientConfig)
 		if err != nil {
 			return fmt.Errorf("SSH daemon handshake failed: %w", err)
 		}
 		defer client.Close()
 
-		relaysshd.Run(server, serverNewChans, serverGlobalReqs, client, clientNewChans, clientGlobalReqs)
+		stop := make(chan struct{})
+		defer close(stop)
+		go sshd.RunKeepalive(server, stop)
+		go sshd.RunKeepalive(client, stop)
+
+		relaysshd.Run(server, serverNewChans, serverGlobalReqs, client, clientNewChans, clientGlobalReqs, relaysshd.Options{
+			DisableAgentForward: noAgentForward,
+		})
 		return nil
 	},
 }
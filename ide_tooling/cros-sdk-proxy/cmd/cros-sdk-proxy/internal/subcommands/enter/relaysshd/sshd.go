@@ -9,19 +9,30 @@ import (
 	"sync"
 
 	"golang.org/x/crypto/ssh"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshchan"
 )
 
-func Run(server *ssh.ServerConn, serverNewChans <-chan ssh.NewChannel, serverGlobalReqs <-chan *ssh.Request, client ssh.Conn, clientNewChans <-chan ssh.NewChannel, clientGlobalReqs <-chan *ssh.Request) {
+// Options controls which requests Run forwards between the two ends of the
+// relay. The zero value forwards everything.
+type Options struct {
+	// DisableAgentForward, if set, rejects "auth-agent-req@openssh.com"
+	// channel requests instead of forwarding them to the daemon, so that
+	// ssh-agent sockets are never exposed inside the chroot.
+	DisableAgentForward bool
+}
+
+func Run(server *ssh.ServerConn, serverNewChans <-chan ssh.NewChannel, serverGlobalReqs <-chan *ssh.Request, client ssh.Conn, clientNewChans <-chan ssh.NewChannel, clientGlobalReqs <-chan *ssh.Request, opts Options) {
 	var wg sync.WaitGroup
 	wg.Add(4)
 
 	go func() {
 		defer wg.Done()
-		relayNewChannels(client, serverNewChans)
+		relayNewChannels(client, serverNewChans, opts)
 	}()
 	go func() {
 		defer wg.Done()
-		relayNewChannels(server, clientNewChans)
+		relayNewChannels(server, clientNewChans, opts)
 	}()
 	go func() {
 		defer wg.Done()
@@ -45,20 +56,20 @@ func relayGlobalRequests(dstConn ssh.Conn, srcReqs <-chan *ssh.Request) {
 	}
 }
 
-func relayNewChannels(dstConn ssh.Conn, srcNewChans <-chan ssh.NewChannel) {
+func relayNewChannels(dstConn ssh.Conn, srcNewChans <-chan ssh.NewChannel, opts Options) {
 	var wg sync.WaitGroup
 	for newChan := range srcNewChans {
 		newChan := newChan
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			handleNewChannel(dstConn, newChan)
+			handleNewChannel(dstConn, newChan, opts)
 		}()
 	}
 	wg.Wait()
 }
 
-func handleNewChannel(dstConn ssh.Conn, newChan ssh.NewChannel) {
+func handleNewChannel(dstConn ssh.Conn, newChan ssh.NewChannel, opts Options) {
 	dstChan, dstChanReqs, err := dstConn.OpenChannel(newChan.ChannelType(), newChan.ExtraData())
 	if err != nil {
 		if err, ok := err.(*ssh.OpenChannelError); ok {
@@ -78,16 +89,16 @@ func handleNewChannel(dstConn ssh.Conn, newChan ssh.NewChannel) {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		relayChannel(dstChan, srcChan, srcChanReqs)
+		relayChannel(dstChan, srcChan, srcChanReqs, opts)
 	}()
 	go func() {
 		defer wg.Done()
-		relayChannel(srcChan, dstChan, dstChanReqs)
+		relayChannel(srcChan, dstChan, dstChanReqs, opts)
 	}()
 	wg.Wait()
 }
 
-func relayChannel(dstChan, srcChan ssh.Channel, srcReqs <-chan *ssh.Request) {
+func relayChannel(dstChan, srcChan ssh.Channel, srcReqs <-chan *ssh.Request, opts Options) {
 	defer dstChan.Close()
 
 	var wg sync.WaitGroup
@@ -99,7 +110,7 @@ func relayChannel(dstChan, srcChan ssh.Channel, srcReqs <-chan *ssh.Request) {
 	}()
 	go func() {
 		defer wg.Done()
-		relayChannelRequests(dstChan, srcReqs)
+		relayChannelRequests(dstChan, srcReqs, opts)
 	}()
 
 	wg.Wait()
@@ -112,8 +123,7 @@ func relayChannelData(dstChan, srcChan ssh.Channel) {
 	// Relay stdout.
 	go func() {
 		defer wg.Done()
-		io.Copy(dstChan, srcChan)
-		dstChan.CloseWrite()
+		sshchan.CopyHalf(dstChan, srcChan)
 	}()
 
 	// Relay stderr.
@@ -125,8 +135,12 @@ func relayChannelData(dstChan, srcChan ssh.Channel) {
 	wg.Wait()
 }
 
-func relayChannelRequests(dstChan ssh.Channel, srcReqs <-chan *ssh.Request) {
+func relayChannelRequests(dstChan ssh.Channel, srcReqs <-chan *ssh.Request, opts Options) {
 	for req := range srcReqs {
+		if opts.DisableAgentForward && req.Type == "auth-agent-req@openssh.com" {
+			req.Reply(false, nil)
+			continue
+		}
 		ok, err := dstChan.SendRequest(req.Type, req.WantReply, req.Payload)
 		if err != nil {
 			return
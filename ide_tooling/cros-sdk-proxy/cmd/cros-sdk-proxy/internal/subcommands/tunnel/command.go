@@ -0,0 +1,303 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package tunnel implements the "tunnel" subcommand, which forwards TCP
+// ports to and from a Chrome OS chroot without driving a full interactive
+// session. It reuses the same chroot-entry and daemon handshake as the
+// enter subcommand, but drives the resulting SSH connection itself instead
+// of relaying it to an external SSH client.
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/chroot"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/logging"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/askpasssrv"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/pipe"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshchan"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/utils/sshd"
+)
+
+var flagRootDir = &cli.StringFlag{
+	Name:     "root",
+	Required: true,
+	Usage:    "path to a Chrome OS source checkout",
+}
+
+var flagLoopback = &cli.BoolFlag{
+	Name:   "loopback",
+	Hidden: true,
+	Usage:  "executes a local shell instead of entering chroot (for testing only)",
+}
+
+var flagLocalForward = &cli.StringSliceFlag{
+	Name:    "L",
+	Aliases: []string{"local-forward"},
+	Usage:   "forward a local port into the chroot, as bind_port:host:host_port",
+}
+
+var flagRemoteForward = &cli.StringSliceFlag{
+	Name:    "R",
+	Aliases: []string{"remote-forward"},
+	Usage:   "forward a port inside the chroot to the host, as bind_port:host:host_port",
+}
+
+// forward is a parsed -L/-R argument.
+type forward struct {
+	bindPort uint32
+	host     string
+	hostPort uint32
+}
+
+func parseForward(spec string) (forward, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 {
+		return forward{}, fmt.Errorf("invalid forward spec %q, want bind_port:host:host_port", spec)
+	}
+	bindPort, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return forward{}, fmt.Errorf("invalid bind port in %q: %w", spec, err)
+	}
+	hostPort, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		return forward{}, fmt.Errorf("invalid host port in %q: %w", spec, err)
+	}
+	return forward{bindPort: uint32(bindPort), host: parts[1], hostPort: uint32(hostPort)}, nil
+}
+
+func promptSudoPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "[cros-sdk-proxy] sudo password to enter chroot: ")
+	defer fmt.Fprintln(os.Stderr)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+var Command = &cli.Command{
+	Name: "tunnel",
+	Flags: []cli.Flag{
+		flagRootDir,
+		flagLoopback,
+		flagLocalForward,
+		flagRemoteForward,
+	},
+	Usage: "forwards TCP ports to/from the chroot without a full session",
+	Action: func(c *cli.Context) error {
+		rootDir := c.String(flagRootDir.Name)
+		loopback := c.Bool(flagLoopback.Name)
+
+		var localForwards, remoteForwards []forward
+		for _, spec := range c.StringSlice(flagLocalForward.Name) {
+			f, err := parseForward(spec)
+			if err != nil {
+				return err
+			}
+			localForwards = append(localForwards, f)
+		}
+		for _, spec := range c.StringSlice(flagRemoteForward.Name) {
+			f, err := parseForward(spec)
+			if err != nil {
+				return err
+			}
+			remoteForwards = append(remoteForwards, f)
+		}
+		if len(localForwards) == 0 && len(remoteForwards) == 0 {
+			return fmt.Errorf("at least one -L or -R forward must be specified")
+		}
+
+		logging.Info("Starting tunnel (outside chroot)")
+
+		askpass, err := askpasssrv.New()
+		if err != nil {
+			return err
+		}
+		defer askpass.Close()
+
+		go func() {
+			for {
+				conn, err := askpass.Listener().Accept()
+				if err != nil {
+					return
+				}
+				pass, err := promptSudoPassword()
+				if err == nil {
+					io.WriteString(conn, pass)
+				}
+				conn.Close()
+			}
+		}()
+
+		proc, procStdio, err := chroot.Start(
+			chroot.Args(rootDir, loopback, []string{"--askpass"}, nil),
+			[]string{fmt.Sprintf("SUDO_ASKPASS=%s", askpass.ClientPath())})
+		askpass.Listener().Close()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			procStdio.Close()
+			proc.Process.Signal(unix.SIGTERM)
+			proc.Wait()
+		}()
+
+		knownHosts, err := sshd.DefaultKnownHostsPath()
+		if err != nil {
+			return fmt.Errorf("failed to determine known_hosts path: %w", err)
+		}
+		hostKeyCallback, err := sshd.TOFUHostKeyCallback(knownHosts, rootDir)
+		if err != nil {
+			return fmt.Errorf("failed to set up daemon host key pinning: %w", err)
+		}
+
+		clientConfig := &ssh.ClientConfig{
+			HostKeyCallback: hostKeyCallback,
+		}
+		client, newChans, globalReqs, err := ssh.NewClientConn(pipe.NewConn(procStdio, procStdio), rootDir, clientConfig)
+		if err != nil {
+			return fmt.Errorf("SSH daemon handshake failed: %w", err)
+		}
+		defer client.Close()
+
+		// The daemon never sends us global requests, but discard them
+		// defensively rather than leaving the channel unread.
+		go ssh.DiscardRequests(globalReqs)
+
+		remoteTargets := make(map[uint32]forward)
+		for _, f := range remoteForwards {
+			remoteTargets[f.bindPort] = f
+		}
+		go serveForwardedChannels(client, newChans, remoteTargets)
+
+		for _, f := range localForwards {
+			if err := serveLocalForward(client, f); err != nil {
+				return err
+			}
+		}
+		for _, f := range remoteForwards {
+			if err := requestRemoteForward(client, f); err != nil {
+				return err
+			}
+		}
+
+		logging.Info("Tunnel ready; press Ctrl-C to stop")
+		select {}
+	},
+}
+
+// serveLocalForward listens on f.bindPort and, for every accepted
+// connection, opens a "direct-tcpip" channel to f.host:f.hostPort inside the
+// chroot.
+func serveLocalForward(client ssh.Conn, f forward) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", f.bindPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen on local port %d: %w", f.bindPort, err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				localAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+				remoteAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+				payload := sshchan.DirectTCPIPPayload{
+					TargetHost: f.host,
+					TargetPort: f.hostPort,
+				}
+				if localAddr != nil {
+					payload.OriginatorHost = localAddr.IP.String()
+				}
+				if remoteAddr != nil {
+					payload.OriginatorPort = uint32(remoteAddr.Port)
+				}
+				ch, reqs, err := client.OpenChannel("direct-tcpip", ssh.Marshal(&payload))
+				if err != nil {
+					logging.Errorf("Failed to open direct-tcpip channel to %s:%d: %v", f.host, f.hostPort, err)
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				sshchan.Bridge(ch, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// requestRemoteForward asks the daemon to bind f.bindPort inside the chroot
+// and forward connections on it back to us.
+func requestRemoteForward(client ssh.Conn, f forward) error {
+	ok, reply, err := client.SendRequest("tcpip-forward", true, ssh.Marshal(&sshchan.TCPIPForwardPayload{
+		BindAddress: "localhost",
+		BindPort:    f.bindPort,
+	}))
+	if err != nil {
+		return fmt.Errorf("tcpip-forward request failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("daemon rejected tcpip-forward for port %d", f.bindPort)
+	}
+	var success sshchan.TCPIPForwardSuccessPayload
+	if len(reply) > 0 {
+		if err := ssh.Unmarshal(reply, &success); err == nil {
+			f.bindPort = success.BindPort
+		}
+	}
+	logging.Infof("Forwarding chroot port %d to %s:%d", f.bindPort, f.host, f.hostPort)
+	return nil
+}
+
+// serveForwardedChannels handles "forwarded-tcpip" channels opened by the
+// daemon in response to a tcpip-forward request, dialing the corresponding
+// local target and bridging the connection.
+func serveForwardedChannels(client ssh.Conn, newChans <-chan ssh.NewChannel, targets map[uint32]forward) {
+	for newChan := range newChans {
+		if newChan.ChannelType() != "forwarded-tcpip" {
+			newChan.Reject(ssh.UnknownChannelType, fmt.Sprintf("unsupported channel type: %s", newChan.ChannelType()))
+			continue
+		}
+
+		var p sshchan.ForwardedTCPIPPayload
+		if err := ssh.Unmarshal(newChan.ExtraData(), &p); err != nil {
+			newChan.Reject(ssh.Prohibited, fmt.Sprintf("corrupted forwarded-tcpip payload: %v", err))
+			continue
+		}
+		target, ok := targets[p.ConnectedPort]
+		if !ok {
+			newChan.Reject(ssh.Prohibited, fmt.Sprintf("no forward registered for port %d", p.ConnectedPort))
+			continue
+		}
+
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+
+		go func() {
+			conn, err := net.Dial("tcp", net.JoinHostPort(target.host, strconv.FormatUint(uint64(target.hostPort), 10)))
+			if err != nil {
+				logging.Errorf("Failed to dial forward target %s:%d: %v", target.host, target.hostPort, err)
+				ch.Close()
+				return
+			}
+			sshchan.Bridge(ch, conn)
+		}()
+	}
+}
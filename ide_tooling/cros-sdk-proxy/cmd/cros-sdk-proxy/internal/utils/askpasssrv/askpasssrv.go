@@ -1,8 +1,11 @@
-// Copyright 2021 The Chromium OS Authors. All rights reserved.
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
 // Use of this source code is governed by a BSD-style license that can be
 // found in the LICENSE file.
 
-package enter
+// Package askpasssrv runs a UNIX domain socket server that the askpass
+// subcommand connects to in order to relay a sudo password into a
+// subprocess that was started with SUDO_ASKPASS pointed at it.
+package askpasssrv
 
 import (
 	"fmt"
@@ -15,13 +18,16 @@ import (
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/askpass"
 )
 
-type askpassServer struct {
+// Server listens on a UNIX domain socket and hands out a helper script
+// (ClientPath) that can be set as SUDO_ASKPASS to connect back to it.
+type Server struct {
 	tempDir    string
 	clientPath string
 	listener   net.Listener
 }
 
-func newAskpassServer() (_ *askpassServer, retErr error) {
+// New starts a new askpass server.
+func New() (_ *Server, retErr error) {
 	tempDir, err := os.MkdirTemp("", "cros-sdk-proxy.*")
 	if err != nil {
 		return nil, err
@@ -59,22 +65,22 @@ func newAskpassServer() (_ *askpassServer, retErr error) {
 		return nil, err
 	}
 
-	return &askpassServer{
+	return &Server{
 		tempDir:    tempDir,
 		clientPath: clientPath,
 		listener:   listener,
 	}, nil
 }
 
-func (s *askpassServer) Listener() net.Listener {
+func (s *Server) Listener() net.Listener {
 	return s.listener
 }
 
-func (s *askpassServer) ClientPath() string {
+func (s *Server) ClientPath() string {
 	return s.clientPath
 }
 
-func (s *askpassServer) Close() error {
+func (s *Server) Close() error {
 	var firstErr error
 	if err := s.listener.Close(); err != nil && firstErr == nil {
 		firstErr = err
@@ -5,38 +5,202 @@
 package pipe
 
 import (
-	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
-var (
-	// fakeAddr is a fake IPv4 address.
-	fakeAddr = &net.IPAddr{IP: net.IPv4zero}
+// fakeAddr is a fake IPv4 address.
+var fakeAddr = &net.IPAddr{IP: net.IPv4zero}
 
-	// errNotImpl is returned from unimplemented methods in Conn.
-	errNotImpl = errors.New("not implemented")
-)
+// timeoutError is returned by Read/Write once a deadline set via
+// SetDeadline, SetReadDeadline or SetWriteDeadline elapses. It implements
+// net.Error so that callers such as golang.org/x/crypto/ssh's keepalive and
+// handshake-timeout logic recognize it as a timeout rather than a fatal
+// error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "pipe: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// readDeadliner and writeDeadliner are implemented by *os.File and other
+// descriptors (pipes, sockets) that support native, interruptible
+// deadlines. Conn forwards deadlines to them directly when available,
+// since that's the only way to actually cancel an in-flight Read/Write.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
 
-// Conn is a pseudo net.Conn implementation based on io.Reader and io.Writer.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// asyncResult is the outcome of a Read or Write run in a background
+// goroutine.
+type asyncResult struct {
+	n   int
+	err error
+}
+
+// Conn is a pseudo net.Conn implementation based on io.Reader and
+// io.Writer. When the wrapped reader/writer natively supports deadlines
+// (as *os.File does for the pipes and sockets every caller in this repo
+// passes), Conn forwards deadlines to it directly. Otherwise, since a
+// plain io.Reader/io.Writer gives no way to interrupt a call already in
+// flight, Conn runs it in a background goroutine and races it against a
+// timer, so Read/Write at least return a timeout once the deadline passes
+// instead of blocking forever.
 type Conn struct {
 	r io.Reader
 	w io.Writer
+
+	readMu       sync.Mutex
+	readPending  []byte             // bytes left over from a background read that outran its deadline
+	readErr      error              // sticky error from that same background read
+	readInFlight <-chan asyncResult // non-nil while a background read from a previous, timed-out call hasn't completed yet
+	readBuf      []byte             // buffer backing readInFlight's eventual result
+
+	writeMu sync.Mutex
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 }
 
 func NewConn(r io.Reader, w io.Writer) *Conn {
 	return &Conn{r: r, w: w}
 }
 
-// Read reads data from the underlying io.Reader.
-func (c *Conn) Read(b []byte) (n int, err error) {
-	return c.r.Read(b)
+// Read reads data from the underlying io.Reader, honoring any deadline set
+// with SetDeadline or SetReadDeadline.
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, ok := c.r.(readDeadliner); ok {
+		return c.r.Read(b)
+	}
+	return c.readWithDeadline(b)
+}
+
+// Write writes data to the underlying io.Writer, honoring any deadline set
+// with SetDeadline or SetWriteDeadline.
+func (c *Conn) Write(b []byte) (int, error) {
+	if _, ok := c.w.(writeDeadliner); ok {
+		return c.w.Write(b)
+	}
+	return c.writeWithDeadline(b)
 }
 
-// Write writes data to the underlying io.Writer.
-func (c *Conn) Write(b []byte) (n int, err error) {
-	return c.w.Write(b)
+// readWithDeadline is used when the underlying reader doesn't support
+// native deadlines. It first drains any bytes left over from a previous
+// background read that outran its deadline, then races a background read
+// against the current read deadline.
+//
+// A plain io.Reader gives no way to cancel a Read already in flight, so a
+// read that outran its deadline is still running in the background when
+// this is called again. c.readInFlight tracks that one background read
+// across calls instead of starting a second, concurrent c.r.Read on the
+// same reader, which would risk the two calls' results (or the data
+// between them) getting interleaved or corrupted.
+func (c *Conn) readWithDeadline(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.readPending) > 0 {
+		n := copy(b, c.readPending)
+		c.readPending = c.readPending[n:]
+		return n, nil
+	}
+	if c.readErr != nil {
+		err := c.readErr
+		c.readErr = nil
+		return 0, err
+	}
+
+	c.deadlineMu.Lock()
+	deadline := c.readDeadline
+	c.deadlineMu.Unlock()
+	if !deadline.IsZero() && !deadline.After(time.Now()) {
+		return 0, timeoutError{}
+	}
+
+	resCh := c.readInFlight
+	buf := c.readBuf
+	if resCh == nil {
+		buf = make([]byte, len(b))
+		ch := make(chan asyncResult, 1)
+		go func() {
+			n, err := c.r.Read(buf)
+			ch <- asyncResult{n, err}
+		}()
+		resCh, c.readInFlight = ch, ch
+		c.readBuf = buf
+	}
+
+	var timeoutCh <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case res := <-resCh:
+		c.readInFlight, c.readBuf = nil, nil
+		n := copy(b, buf[:res.n])
+		if n < res.n {
+			c.readPending = append(c.readPending, buf[n:res.n]...)
+		}
+		if res.err != nil {
+			if n == 0 {
+				return 0, res.err
+			}
+			c.readErr = res.err
+		}
+		return n, nil
+	case <-timeoutCh:
+		// Leave c.readInFlight/c.readBuf set so the next call picks up
+		// this same background read instead of starting another one.
+		return 0, timeoutError{}
+	}
+}
+
+// writeWithDeadline is used when the underlying writer doesn't support
+// native deadlines. It starts a background write and races it against the
+// current write deadline.
+func (c *Conn) writeWithDeadline(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.deadlineMu.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMu.Unlock()
+	if !deadline.IsZero() && !deadline.After(time.Now()) {
+		return 0, timeoutError{}
+	}
+
+	resCh := make(chan asyncResult, 1)
+	go func() {
+		n, err := c.w.Write(b)
+		resCh <- asyncResult{n, err}
+	}()
+
+	var timeoutCh <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case res := <-resCh:
+		return res.n, res.err
+	case <-timeoutCh:
+		// The write may still complete in the background; there's nothing
+		// useful to do with its result once we've already reported a
+		// timeout, so let it finish silently.
+		return 0, timeoutError{}
+	}
 }
 
 // Close does nothing.
@@ -54,19 +218,39 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return fakeAddr
 }
 
-// SetDeadline always returns not implemented error.
+// SetDeadline sets both the read and write deadlines. See SetReadDeadline
+// and SetWriteDeadline.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return errNotImpl
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
 }
 
-// SetReadDeadline always returns not implemented error.
+// SetReadDeadline sets the deadline for future Read calls. If the
+// underlying reader supports native deadlines, it's forwarded there;
+// otherwise it's applied by readWithDeadline.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return errNotImpl
+	if dl, ok := c.r.(readDeadliner); ok {
+		return dl.SetReadDeadline(t)
+	}
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.readDeadline = t
+	return nil
 }
 
-// SetWriteDeadline always returns not implemented error.
+// SetWriteDeadline sets the deadline for future Write calls. If the
+// underlying writer supports native deadlines, it's forwarded there;
+// otherwise it's applied by writeWithDeadline.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return errNotImpl
+	if dl, ok := c.w.(writeDeadliner); ok {
+		return dl.SetWriteDeadline(t)
+	}
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.writeDeadline = t
+	return nil
 }
 
 var _ net.Conn = &Conn{}
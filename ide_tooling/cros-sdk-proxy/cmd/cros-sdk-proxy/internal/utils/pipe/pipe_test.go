@@ -0,0 +1,117 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package pipe
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingReader is an io.Reader with no native deadline support, so Conn's
+// fallback path (readWithDeadline) is exercised instead of the native-file
+// path every other caller in this repo takes. Read blocks until ready is
+// closed, so tests can control exactly when a background read completes.
+type blockingReader struct {
+	ready chan struct{}
+	data  []byte
+	err   error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+
+	<-r.ready
+	n := copy(p, r.data)
+	return n, r.err
+}
+
+func (r *blockingReader) callCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func TestConnReadWithDeadlineTimeout(t *testing.T) {
+	r := &blockingReader{ready: make(chan struct{})}
+	c := NewConn(r, io.Discard)
+
+	if err := c.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	_, err := c.Read(make([]byte, 16))
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("Read = _, %v, want a timeout error", err)
+	}
+}
+
+// TestConnReadWithDeadlineFallbackReusesInFlightRead exercises the case
+// where a deadline fires while the background read it raced against is
+// still blocked in the underlying reader. A naive implementation would
+// start a second, concurrent call to the same reader's Read on the next
+// Conn.Read instead of waiting on the one already in flight.
+func TestConnReadWithDeadlineFallbackReusesInFlightRead(t *testing.T) {
+	r := &blockingReader{ready: make(chan struct{}), data: []byte("hello")}
+	c := NewConn(r, io.Discard)
+
+	// Two calls time out in turn while the underlying Read is still
+	// blocked.
+	for i := 0; i < 2; i++ {
+		if err := c.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+			t.Fatalf("SetReadDeadline: %v", err)
+		}
+		_, err := c.Read(make([]byte, 16))
+		netErr, ok := err.(net.Error)
+		if !ok || !netErr.Timeout() {
+			t.Fatalf("Read #%d = _, %v, want a timeout error", i, err)
+		}
+	}
+	if got := r.callCount(); got != 1 {
+		t.Fatalf("underlying Read called %d times while still in flight, want 1 (a second call races the same reader)", got)
+	}
+
+	// Let the underlying Read complete, then expect its data with no
+	// further deadline.
+	close(r.ready)
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got, want := string(buf[:n]), "hello"; got != want {
+		t.Errorf("Read = %q, want %q", got, want)
+	}
+	if got := r.callCount(); got != 1 {
+		t.Errorf("underlying Read called %d times overall, want 1", got)
+	}
+}
+
+func TestConnReadWithDeadlinePastDeadline(t *testing.T) {
+	r := &blockingReader{ready: make(chan struct{})}
+	c := NewConn(r, io.Discard)
+
+	if err := c.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	_, err := c.Read(make([]byte, 16))
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("Read = _, %v, want a timeout error", err)
+	}
+	if got := r.callCount(); got != 0 {
+		t.Errorf("underlying Read called %d times for an already-past deadline, want 0", got)
+	}
+}
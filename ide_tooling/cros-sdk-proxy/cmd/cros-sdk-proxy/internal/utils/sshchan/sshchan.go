@@ -0,0 +1,85 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package sshchan holds the wire payload types and channel-bridging helper
+// shared by every part of cros-sdk-proxy that forwards TCP connections over
+// an SSH connection's "direct-tcpip"/"tcpip-forward" channels and global
+// requests: daemonsshd (inside the chroot) and the tunnel subcommand
+// (outside it).
+package sshchan
+
+import (
+	"io"
+	"sync"
+)
+
+// These mirror the wire payloads used for "direct-tcpip"/"tcpip-forward"
+// and their related channels/global requests; see RFC 4254 section 7.
+
+type DirectTCPIPPayload struct {
+	TargetHost     string
+	TargetPort     uint32
+	OriginatorHost string
+	OriginatorPort uint32
+}
+
+type TCPIPForwardPayload struct {
+	BindAddress string
+	BindPort    uint32
+}
+
+type TCPIPForwardSuccessPayload struct {
+	BindPort uint32
+}
+
+type CancelTCPIPForwardPayload struct {
+	BindAddress string
+	BindPort    uint32
+}
+
+type ForwardedTCPIPPayload struct {
+	ConnectedHost  string
+	ConnectedPort  uint32
+	OriginatorHost string
+	OriginatorPort uint32
+}
+
+// CloseWriter is implemented by types (such as ssh.Channel, *net.TCPConn,
+// and *net.UnixConn) that support half-closing their write side
+// independently of Close.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// CopyHalf copies from src to dst until src is drained, then half-closes
+// dst's write side if it implements CloseWriter. It's one direction of a
+// bidirectional forward; run it from its own goroutine in each direction to
+// bridge two channels/connections.
+func CopyHalf(dst io.Writer, src io.Reader) {
+	io.Copy(dst, src)
+	if cw, ok := dst.(CloseWriter); ok {
+		cw.CloseWrite()
+	}
+}
+
+// Bridge copies data bidirectionally between a and b until both directions
+// have drained, then closes both endpoints. This is the forwarding pattern
+// behind every "direct-tcpip"/"forwarded-tcpip" channel cros-sdk-proxy
+// bridges to a local connection.
+func Bridge(a, b io.ReadWriteCloser) {
+	defer a.Close()
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		CopyHalf(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		CopyHalf(b, a)
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultHostKeyPath returns the path, inside the chroot, at which the
+// daemon's host key is persisted. It's a fixed path rather than one derived
+// from the caller's root dir, since the daemon only ever sees its own
+// chroot's filesystem, which is already the thing TOFUHostKeyCallback keys
+// its pinning on from the relay side.
+func DefaultHostKeyPath() string {
+	return "/var/lib/cros-sdk-proxy/host_key"
+}
+
+// PersistentSigner returns an ssh.Signer backed by an Ed25519 private key
+// stored at path, generating and persisting one the first time it's
+// called. Reusing the same key across daemon invocations is what lets
+// TOFUHostKeyCallback's pinning work at all: a freshly generated key on
+// every run would never match what was pinned on a previous one.
+func PersistentSigner(path string) (ssh.Signer, error) {
+	if pemBytes, err := os.ReadFile(path); err == nil {
+		priv, err := ssh.ParseRawPrivateKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse persisted host key %s: %w", path, err)
+		}
+		return ssh.NewSignerFromKey(priv)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read persisted host key %s: %w", path, err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate host key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal host key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory: %w", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, fmt.Errorf("failed to persist host key %s: %w", path, err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap host key: %w", err)
+	}
+	return signer, nil
+}
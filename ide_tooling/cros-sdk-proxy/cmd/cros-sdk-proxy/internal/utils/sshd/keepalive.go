@@ -0,0 +1,64 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sshd
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// KeepaliveInterval is how often RunKeepalive probes a connection.
+	KeepaliveInterval = 30 * time.Second
+
+	// KeepaliveTimeout is how long RunKeepalive waits for a keepalive
+	// reply before giving up on the connection.
+	KeepaliveTimeout = 10 * time.Second
+)
+
+// RunKeepalive sends a "keepalive@openssh.com" global request on conn every
+// KeepaliveInterval, like OpenSSH's ServerAliveInterval, and closes conn if
+// a reply doesn't arrive within KeepaliveTimeout. This is what notices a
+// half-open connection (dropped VPN, laptop sleep) and tears it down
+// instead of leaving a zombie cros_sdk process running forever. It blocks
+// until stop is closed or a keepalive times out, so it should be run in its
+// own goroutine.
+func RunKeepalive(conn ssh.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := probeKeepalive(conn); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// probeKeepalive sends a single keepalive request and waits up to
+// KeepaliveTimeout for any reply. The reply's content is irrelevant (peers
+// that don't recognize the request type reply false); only a timeout,
+// meaning nothing answered at all, is treated as a failure.
+func probeKeepalive(conn ssh.Conn) error {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(KeepaliveTimeout):
+		return fmt.Errorf("timed out waiting for keepalive reply")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultKnownHostsPath returns the path to the known_hosts-style file used
+// to pin an in-chroot daemon's host key across proxy invocations.
+func DefaultKnownHostsPath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "cros-sdk-proxy", "daemon_known_hosts"), nil
+}
+
+// TOFUHostKeyCallback returns a ssh.HostKeyCallback that pins the host key
+// seen for id on first use, and verifies it on every subsequent connection.
+// Pinned keys are persisted in a known_hosts-style file under path so that
+// pinning survives across proxy invocations; a daemon host key that changes
+// between runs (e.g. because the chroot was recreated by someone else) is
+// treated as a hard failure rather than silently re-pinned.
+func TOFUHostKeyCallback(path string, id string) (ssh.HostKeyCallback, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create known_hosts directory: %w", err)
+	}
+	if _, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, fmt.Errorf("failed to create known_hosts file: %w", err)
+	}
+
+	// id identifies a chroot (e.g. its root directory), not a network
+	// address, so it won't generally have the "host:port" shape the
+	// knownhosts package requires of its lookup key. Give it one.
+	id = normalizeID(id)
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		verify, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("failed to load known_hosts: %w", err)
+		}
+
+		err = verify(id, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if ok := errors.As(err, &keyErr); !ok || len(keyErr.Want) > 0 {
+			// Either an unexpected error, or the daemon presented a key
+			// that doesn't match a previously pinned one. Treat both as
+			// fatal: a changed host key indicates the daemon was
+			// recreated (or is being impersonated) and must be
+			// re-pinned explicitly by the user.
+			return fmt.Errorf("daemon host key verification failed for %s (possible impersonation or recreated chroot; remove the entry from %s to re-pin): %w", id, path, err)
+		}
+
+		// No entry for this host yet: pin it (trust on first use).
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open known_hosts for pinning: %w", err)
+		}
+		defer f.Close()
+
+		line := knownhosts.Line([]string{id}, key)
+		if _, err := fmt.Fprintln(f, line); err != nil {
+			return fmt.Errorf("failed to pin daemon host key: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// normalizeID gives id a "host:port" shape if it doesn't already have one,
+// so it can be used as a knownhosts lookup key.
+func normalizeID(id string) string {
+	if _, _, err := net.SplitHostPort(id); err == nil {
+		return id
+	}
+	return net.JoinHostPort(id, "0")
+}
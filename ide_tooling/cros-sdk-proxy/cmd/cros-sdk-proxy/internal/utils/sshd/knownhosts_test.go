@@ -0,0 +1,73 @@
+// Copyright 2022 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func mustSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	return signer
+}
+
+// testHostID looks like a chroot root directory, not a network address,
+// matching how enter/command.go actually calls TOFUHostKeyCallback: it
+// exercises normalizeID's handling of an id with no "host:port" shape.
+const testHostID = "/home/user/chromiumos"
+
+func TestTOFUHostKeyCallbackPinsOnFirstUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	callback, err := TOFUHostKeyCallback(path, testHostID)
+	if err != nil {
+		t.Fatalf("TOFUHostKeyCallback: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	key := mustSigner(t).PublicKey()
+
+	if err := callback(testHostID, addr, key); err != nil {
+		t.Fatalf("first callback invocation: %v", err)
+	}
+	// The same key should verify cleanly on every later connection.
+	if err := callback(testHostID, addr, key); err != nil {
+		t.Errorf("second callback invocation with the same key: %v", err)
+	}
+}
+
+func TestTOFUHostKeyCallbackRejectsMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	callback, err := TOFUHostKeyCallback(path, testHostID)
+	if err != nil {
+		t.Fatalf("TOFUHostKeyCallback: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	if err := callback(testHostID, addr, mustSigner(t).PublicKey()); err != nil {
+		t.Fatalf("first callback invocation: %v", err)
+	}
+
+	err = callback(testHostID, addr, mustSigner(t).PublicKey())
+	if err == nil {
+		t.Fatal("callback with a different key for an already-pinned root: got nil error, want mismatch error")
+	}
+	if !strings.Contains(err.Error(), "verification failed") {
+		t.Errorf("callback error = %v, want a verification failure mentioning the mismatch", err)
+	}
+}
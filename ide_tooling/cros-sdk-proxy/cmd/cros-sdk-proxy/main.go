@@ -13,6 +13,7 @@ import (
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/askpass"
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/daemon"
 	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/enter"
+	"go.chromium.org/vscode/cmd/cros-sdk-proxy/internal/subcommands/tunnel"
 )
 
 var app = &cli.App{
@@ -21,6 +22,7 @@ var app = &cli.App{
 		enter.Command,
 		daemon.Command,
 		askpass.Command,
+		tunnel.Command,
 	},
 	Usage: "provides SSH access to CrOS chroot",
 }